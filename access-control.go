@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ROLE_ATTRIBUTE is the certificate attribute carrying the caller's role.
+const ROLE_ATTRIBUTE = "role"
+
+// PARTICIPANT_ATTRIBUTE is the certificate attribute carrying the caller's
+// participant ID, the same ID used as sender, logistics and receiver.
+const PARTICIPANT_ATTRIBUTE = "participant_id"
+
+const ROLE_SUPPLIER = "supplier"
+const ROLE_LOGISTICS = "logistics"
+const ROLE_DISTRIBUTOR = "distributor"
+const ROLE_PHARMACY = "pharmacy"
+const ROLE_REGULATOR = "regulator"
+const ROLE_ADMIN = "admin"
+
+var allRoles = []string{ROLE_SUPPLIER, ROLE_LOGISTICS, ROLE_DISTRIBUTOR, ROLE_PHARMACY, ROLE_REGULATOR, ROLE_ADMIN}
+
+// getCallerRole reads the role attribute from the transaction certificate.
+func getCallerRole(stub shim.ChaincodeStubInterface) (string, error) {
+	role, err := stub.ReadCertAttribute(ROLE_ATTRIBUTE)
+	if err != nil {
+		return "", newError(ERR_FORBIDDEN, "Failed to read the "+ROLE_ATTRIBUTE+" attribute from the caller certificate")
+	}
+	return string(role), nil
+}
+
+// checkRole returns an error unless the caller's role is one of roles.
+func checkRole(stub shim.ChaincodeStubInterface, function string, roles []string) error {
+	role, err := getCallerRole(stub)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range roles {
+		if allowed == role {
+			return nil
+		}
+	}
+	fmt.Println("role " + role + " denied for func: " + function)
+	return newError(ERR_FORBIDDEN, "Role "+role+" is not allowed to call "+function)
+}
+
+// checkNamedReceiver returns an error unless partyID is the receiver the
+// provenance names for the container's current leg.
+func checkNamedReceiver(container Container, partyID string) error {
+	if container.Provenance.Receiver != partyID {
+		return newError(ERR_FORBIDDEN, "Party "+partyID+" is not the receiver named for container "+container.ContainerId)
+	}
+	return nil
+}
+
+// getCallerID reads the participant the transaction certificate was issued to.
+func getCallerID(stub shim.ChaincodeStubInterface) (string, error) {
+	callerID, err := stub.ReadCertAttribute(PARTICIPANT_ATTRIBUTE)
+	if err != nil || len(callerID) == 0 {
+		return "", newError(ERR_FORBIDDEN, "Failed to read the "+PARTICIPANT_ATTRIBUTE+" attribute from the caller certificate")
+	}
+	return string(callerID), nil
+}
+
+// checkCaller returns an error unless the transaction was submitted by partyID,
+// so that no participant can act in the supply chain under another one's name.
+func checkCaller(stub shim.ChaincodeStubInterface, partyID string) error {
+	callerID, err := getCallerID(stub)
+	if err != nil {
+		return err
+	}
+	if callerID != partyID {
+		fmt.Println("caller " + callerID + " claimed to be " + partyID)
+		return newError(ERR_FORBIDDEN, "Caller "+callerID+" cannot act as "+partyID)
+	}
+	return nil
+}
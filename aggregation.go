@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SplitContainer moves groups of pallets out of a container into new child
+// containers, one per group, held by the same custodian. splitJSON is a list
+// of pallet ID lists, e.g. [["CON1PAL1"],["CON1PAL2","CON1PAL3"]]. Each child
+// starts with the parent's provenance; a parent left with no pallets is closed
+// out as STATUS_SPLIT.
+func (t *PharmaChaincode) SplitContainer(stub shim.ChaincodeStubInterface, containerID string, splitJSON string) ([]byte, error) {
+	fmt.Println("running SplitContainer:" + containerID)
+	var groups [][]string
+	err := json.Unmarshal([]byte(splitJSON), &groups)
+	if err != nil || len(groups) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "split_json", "Expecting a non-empty list of pallet ID lists")
+	}
+	parent, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, parent.Custodian); err != nil {
+		return nil, err
+	}
+	if err = checkTransition(parent, STATUS_SPLIT); err != nil {
+		return nil, err
+	}
+
+	palletIndexes := make(map[string]int)
+	for index, pallet := range parent.Elements.Pallets {
+		palletIndexes[pallet.PalletId] = index
+	}
+	moved := make(map[string]bool)
+	var violations []string
+	for _, group := range groups {
+		if len(group) == 0 {
+			violations = append(violations, "every child container needs at least one pallet")
+		}
+		for _, palletID := range group {
+			if _, ok := palletIndexes[palletID]; !ok {
+				violations = append(violations, "pallet "+palletID+" is not in container "+containerID)
+			} else if moved[palletID] {
+				violations = append(violations, "pallet "+palletID+" is listed more than once")
+			}
+			moved[palletID] = true
+		}
+	}
+	if len(violations) > 0 {
+		splitErr := newFieldError(ERR_INVALID_ARGUMENT, "split_json", "Split failed validation")
+		splitErr.Violations = violations
+		return nil, splitErr
+	}
+
+	var childIDs []string
+	for _, group := range groups {
+		childID, err := allocateContainerID(stub)
+		if err != nil {
+			return nil, err
+		}
+		child := Container{
+			ContainerId:       childID,
+			ParentContainerId: parent.ContainerId,
+			CertifiedBy:       parent.CertifiedBy,
+			Provenance:        parent.Provenance}
+		for _, palletID := range group {
+			child.Elements.Pallets = append(child.Elements.Pallets, parent.Elements.Pallets[palletIndexes[palletID]])
+		}
+		child.Provenance.Supplychain = append([]ChainActivity(nil), parent.Provenance.Supplychain...)
+		child.Excursions = append([]Excursion(nil), parent.Excursions...)
+		child.Provenance.TransitStatus = STATUS_ACCEPTED
+		chainActivity, err := newChainActivity(stub, parent.Custodian, parent.Custodian, STATUS_SPLIT)
+		if err != nil {
+			return nil, err
+		}
+		chainActivity.RelatedContainers = []string{parent.ContainerId}
+		child.Provenance.Supplychain = append(child.Provenance.Supplychain, chainActivity)
+		if err = transferCustody(stub, &child, parent.Custodian); err != nil {
+			return nil, err
+		}
+		if err = setCurrentOwner(stub, parent.Custodian, childID); err != nil {
+			return nil, err
+		}
+		if err = putContainer(stub, child); err != nil {
+			return nil, err
+		}
+		if err = indexElements(stub, child); err != nil {
+			return nil, err
+		}
+		childIDs = append(childIDs, childID)
+	}
+
+	var remaining []Pallet
+	for _, pallet := range parent.Elements.Pallets {
+		if !moved[pallet.PalletId] {
+			remaining = append(remaining, pallet)
+		}
+	}
+	parent.Elements.Pallets = remaining
+	parent.ChildContainerId = append(parent.ChildContainerId, childIDs...)
+	chainActivity, err := newChainActivity(stub, parent.Custodian, parent.Custodian, STATUS_SPLIT)
+	if err != nil {
+		return nil, err
+	}
+	chainActivity.RelatedContainers = childIDs
+	parent.Provenance.Supplychain = append(parent.Provenance.Supplychain, chainActivity)
+	if len(remaining) == 0 {
+		parent.Provenance.TransitStatus = STATUS_SPLIT
+		if err = releaseCustody(stub, &parent); err != nil {
+			return nil, err
+		}
+	}
+	if err = putContainer(stub, parent); err != nil {
+		return nil, err
+	}
+	jsonVal, _ := json.Marshal(childIDs)
+	return jsonVal, nil
+}
+
+// MergeSource names the pallets to take from one source container. An empty
+// PalletIds takes all of them.
+type MergeSource struct {
+	ContainerId string   `json:"container_id"`
+	PalletIds   []string `json:"pallet_ids"`
+}
+
+// MergeContainers consolidates pallets from source containers into a target
+// container held by the same custodian. When targetID is empty a new
+// container is created as the target. Each source records the target among
+// its children, the target records its sources and, in the aggregation of its
+// merge activity, the source of every pallet. Sources left with no pallets are
+// closed out as STATUS_MERGED.
+func (t *PharmaChaincode) MergeContainers(stub shim.ChaincodeStubInterface, targetID string, mergeJSON string) ([]byte, error) {
+	fmt.Println("running MergeContainers into:" + targetID)
+	var sources []MergeSource
+	err := json.Unmarshal([]byte(mergeJSON), &sources)
+	if err != nil || len(sources) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "merge_json", "Expecting a non-empty list of source containers")
+	}
+	callerID, err := getCallerID(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var target Container
+	if targetID == "" {
+		targetID, err = allocateContainerID(stub)
+		if err != nil {
+			return nil, err
+		}
+		target = Container{ContainerId: targetID}
+		target.Provenance.TransitStatus = STATUS_ACCEPTED
+		if err = transferCustody(stub, &target, callerID); err != nil {
+			return nil, err
+		}
+		if err = setCurrentOwner(stub, callerID, targetID); err != nil {
+			return nil, err
+		}
+	} else {
+		target, err = getContainer(stub, targetID)
+		if err != nil {
+			return nil, err
+		}
+		if target.Custodian != callerID {
+			return nil, newError(ERR_FORBIDDEN, "Container "+targetID+" is held by "+target.Custodian+", not "+callerID)
+		}
+		if target.Provenance.TransitStatus != STATUS_ACCEPTED {
+			return nil, newError(ERR_INVALID_TRANSITION, "Container "+targetID+" cannot take pallets while "+target.Provenance.TransitStatus)
+		}
+	}
+
+	var sourceIDs []string
+	var moves []ElementMove
+	for _, mergeSource := range sources {
+		if mergeSource.ContainerId == targetID {
+			return nil, newFieldError(ERR_INVALID_ARGUMENT, "merge_json", "Container "+targetID+" cannot be merged into itself")
+		}
+		source, err := getContainer(stub, mergeSource.ContainerId)
+		if err != nil {
+			return nil, err
+		}
+		if source.Custodian != callerID {
+			return nil, newError(ERR_FORBIDDEN, "Container "+source.ContainerId+" is held by "+source.Custodian+", not "+callerID)
+		}
+		if err = checkTransition(source, STATUS_MERGED); err != nil {
+			return nil, err
+		}
+
+		palletIDs := make(map[string]bool)
+		for _, palletID := range mergeSource.PalletIds {
+			palletIDs[palletID] = true
+		}
+		moved := make(map[string]bool)
+		var remaining []Pallet
+		for _, pallet := range source.Elements.Pallets {
+			if len(palletIDs) == 0 || palletIDs[pallet.PalletId] {
+				target.Elements.Pallets = append(target.Elements.Pallets, pallet)
+				moved[pallet.PalletId] = true
+				moves = append(moves, ElementMove{pallet.PalletId, source.ContainerId, source.ContainerId})
+			} else {
+				remaining = append(remaining, pallet)
+			}
+		}
+		for _, palletID := range mergeSource.PalletIds {
+			if !moved[palletID] {
+				return nil, newFieldError(ERR_INVALID_ARGUMENT, "merge_json", "Pallet "+palletID+" is not in container "+source.ContainerId)
+			}
+		}
+
+		source.Elements.Pallets = remaining
+		source.ChildContainerId = append(source.ChildContainerId, targetID)
+		chainActivity, err := newChainActivity(stub, callerID, callerID, STATUS_MERGED)
+		if err != nil {
+			return nil, err
+		}
+		chainActivity.RelatedContainers = []string{targetID}
+		source.Provenance.Supplychain = append(source.Provenance.Supplychain, chainActivity)
+		if len(remaining) == 0 {
+			source.Provenance.TransitStatus = STATUS_MERGED
+			if err = releaseCustody(stub, &source); err != nil {
+				return nil, err
+			}
+		}
+		if err = putContainer(stub, source); err != nil {
+			return nil, err
+		}
+		sourceIDs = append(sourceIDs, source.ContainerId)
+	}
+
+	target.MergedFromContainerId = append(target.MergedFromContainerId, sourceIDs...)
+	chainActivity, err := newChainActivity(stub, callerID, callerID, STATUS_MERGED)
+	if err != nil {
+		return nil, err
+	}
+	chainActivity.RelatedContainers = sourceIDs
+	chainActivity.Aggregation = &AggregationEvent{ElementType: ELEMENT_PALLET, ParentId: targetID, Moves: moves}
+	target.Provenance.Supplychain = append(target.Provenance.Supplychain, chainActivity)
+	if err = putContainer(stub, target); err != nil {
+		return nil, err
+	}
+	if err = indexElements(stub, target); err != nil {
+		return nil, err
+	}
+	return []byte(targetID), nil
+}
+
+// AggregationEvent records cases or units repacked into a new parent.
+type AggregationEvent struct {
+	ElementType string        `json:"element_type"`
+	ParentId    string        `json:"parent_id"`
+	Moves       []ElementMove `json:"moves"`
+}
+
+// ElementMove is one element taken out of its previous parent.
+type ElementMove struct {
+	ElementId       string `json:"element_id"`
+	FromParentId    string `json:"from_parent_id"`
+	FromContainerId string `json:"from_container_id"`
+}
+
+// heldContainers loads and caches the containers touched by a repack, so that
+// each one is checked, read and written only once.
+type heldContainers struct {
+	stub     shim.ChaincodeStubInterface
+	callerID string
+	order    []string
+	byID     map[string]*Container
+}
+
+func newHeldContainers(stub shim.ChaincodeStubInterface) (*heldContainers, error) {
+	callerID, err := getCallerID(stub)
+	if err != nil {
+		return nil, err
+	}
+	return &heldContainers{stub: stub, callerID: callerID, byID: make(map[string]*Container)}, nil
+}
+
+// get returns the container, failing unless the caller holds it at rest.
+func (h *heldContainers) get(containerID string) (*Container, error) {
+	if container, ok := h.byID[containerID]; ok {
+		return container, nil
+	}
+	container, err := getContainer(h.stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if container.Custodian != h.callerID {
+		return nil, newError(ERR_FORBIDDEN, "Container "+containerID+" is held by "+container.Custodian+", not "+h.callerID)
+	}
+	if container.Provenance.TransitStatus != STATUS_ACCEPTED {
+		return nil, newError(ERR_INVALID_TRANSITION, "Container "+containerID+" cannot be repacked while "+container.Provenance.TransitStatus)
+	}
+	h.order = append(h.order, containerID)
+	h.byID[containerID] = &container
+	return &container, nil
+}
+
+// save appends the aggregation event to every touched container, writes them
+// back and re-indexes their elements.
+func (h *heldContainers) save(event AggregationEvent) error {
+	for _, containerID := range h.order {
+		container := h.byID[containerID]
+		chainActivity, err := newChainActivity(h.stub, h.callerID, h.callerID, STATUS_AGGREGATED)
+		if err != nil {
+			return err
+		}
+		chainActivity.Aggregation = &event
+		container.Provenance.Supplychain = append(container.Provenance.Supplychain, chainActivity)
+		if err = putContainer(h.stub, *container); err != nil {
+			return err
+		}
+		if err = indexElements(h.stub, *container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MoveCases repacks cases onto another pallet. The cases and the target pallet
+// may sit in any containers the caller currently holds at rest.
+func (t *PharmaChaincode) MoveCases(stub shim.ChaincodeStubInterface, targetPalletID string, caseIDsJSON string) ([]byte, error) {
+	fmt.Println("running MoveCases onto:" + targetPalletID)
+	var caseIDs []string
+	err := json.Unmarshal([]byte(caseIDsJSON), &caseIDs)
+	if err != nil || len(caseIDs) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "case_ids_json", "Expecting a non-empty list of case IDs")
+	}
+	held, err := newHeldContainers(stub)
+	if err != nil {
+		return nil, err
+	}
+	targetLocation, err := getElementLocation(stub, ELEMENT_PALLET, targetPalletID)
+	if err != nil {
+		return nil, err
+	}
+	target, err := held.get(targetLocation.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+
+	locations, err := checkMoves(held, ELEMENT_CASE, caseIDs, targetPalletID)
+	if err != nil {
+		return nil, err
+	}
+	event := AggregationEvent{ElementType: ELEMENT_CASE, ParentId: targetPalletID}
+	for index, caseID := range caseIDs {
+		location := locations[index]
+		source, err := held.get(location.ContainerId)
+		if err != nil {
+			return nil, err
+		}
+		palletCase, err := takeCase(source, location.ParentId, caseID)
+		if err != nil {
+			return nil, err
+		}
+		targetPallet := findPallet(target, targetPalletID)
+		targetPallet.Cases = append(targetPallet.Cases, palletCase)
+		event.Moves = append(event.Moves, ElementMove{caseID, location.ParentId, location.ContainerId})
+	}
+	if err = held.save(event); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// MoveUnits repacks units into another case. The units and the target case may
+// sit in any containers the caller currently holds at rest.
+func (t *PharmaChaincode) MoveUnits(stub shim.ChaincodeStubInterface, targetCaseID string, unitIDsJSON string) ([]byte, error) {
+	fmt.Println("running MoveUnits into:" + targetCaseID)
+	var unitIDs []string
+	err := json.Unmarshal([]byte(unitIDsJSON), &unitIDs)
+	if err != nil || len(unitIDs) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "unit_ids_json", "Expecting a non-empty list of unit IDs")
+	}
+	held, err := newHeldContainers(stub)
+	if err != nil {
+		return nil, err
+	}
+	targetLocation, err := getElementLocation(stub, ELEMENT_CASE, targetCaseID)
+	if err != nil {
+		return nil, err
+	}
+	target, err := held.get(targetLocation.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+
+	locations, err := checkMoves(held, ELEMENT_UNIT, unitIDs, targetCaseID)
+	if err != nil {
+		return nil, err
+	}
+	event := AggregationEvent{ElementType: ELEMENT_UNIT, ParentId: targetCaseID}
+	for index, unitID := range unitIDs {
+		location := locations[index]
+		source, err := held.get(location.ContainerId)
+		if err != nil {
+			return nil, err
+		}
+		unit, err := takeUnit(source, location.ParentId, unitID)
+		if err != nil {
+			return nil, err
+		}
+		targetCase := findCase(target, targetCaseID)
+		targetCase.Units = append(targetCase.Units, unit)
+		event.Moves = append(event.Moves, ElementMove{unitID, location.ParentId, location.ContainerId})
+	}
+	if err = held.save(event); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// checkMoves validates every case or unit of a repack before anything moves
+// and returns their locations. Each must be listed once, exist in a container
+// the caller holds at rest and not already sit in parentID. Units that have
+// left the supply chain or are recalled stay where they are, and so do cases
+// holding recalled units.
+func checkMoves(held *heldContainers, elementType string, elementIDs []string, parentID string) ([]ElementLocation, error) {
+	field := elementType + "_ids_json"
+	var locations []ElementLocation
+	var violations []string
+	listed := make(map[string]bool)
+	for _, elementID := range elementIDs {
+		if listed[elementID] {
+			violations = append(violations, elementType+" "+elementID+" is listed more than once")
+		}
+		listed[elementID] = true
+		location, err := getElementLocation(held.stub, elementType, elementID)
+		if chaincodeErr, ok := err.(*ChaincodeError); ok && chaincodeErr.Code == ERR_NOT_FOUND {
+			violations = append(violations, elementType+" "+elementID+" does not exist")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+		if location.ParentId == parentID {
+			violations = append(violations, elementType+" "+elementID+" is already in "+parentID)
+			continue
+		}
+		source, err := held.get(location.ContainerId)
+		if err != nil {
+			return nil, err
+		}
+		var units []Unit
+		if elementType == ELEMENT_CASE {
+			if palletCase := findCase(source, elementID); palletCase != nil {
+				units = palletCase.Units
+			}
+		} else if _, _, unit := findUnit(*source, elementID); unit != nil {
+			if unitRetired(*unit) {
+				violations = append(violations, "unit "+elementID+" has left the supply chain")
+			}
+			units = []Unit{*unit}
+		}
+		for _, unit := range units {
+			if unit.RecallId != "" && !unitRetired(unit) {
+				violations = append(violations, elementType+" "+elementID+" holds unit "+unit.UnitId+" recalled under "+unit.RecallId)
+				break
+			}
+		}
+	}
+	if len(violations) > 0 {
+		moveErr := newFieldError(ERR_INVALID_ARGUMENT, field, "Repack failed validation")
+		moveErr.Violations = violations
+		return nil, moveErr
+	}
+	return locations, nil
+}
+
+// findPallet returns a pointer into the container's pallets, or nil.
+func findPallet(container *Container, palletID string) *Pallet {
+	for index := range container.Elements.Pallets {
+		if container.Elements.Pallets[index].PalletId == palletID {
+			return &container.Elements.Pallets[index]
+		}
+	}
+	return nil
+}
+
+// findCase returns a pointer into the container's cases, or nil.
+func findCase(container *Container, caseID string) *Case {
+	for palletIndex := range container.Elements.Pallets {
+		cases := container.Elements.Pallets[palletIndex].Cases
+		for caseIndex := range cases {
+			if cases[caseIndex].CaseId == caseID {
+				return &cases[caseIndex]
+			}
+		}
+	}
+	return nil
+}
+
+// takeCase removes a case from its pallet and returns it.
+func takeCase(container *Container, palletID string, caseID string) (Case, error) {
+	pallet := findPallet(container, palletID)
+	if pallet != nil {
+		for index, palletCase := range pallet.Cases {
+			if palletCase.CaseId == caseID {
+				pallet.Cases = append(pallet.Cases[:index], pallet.Cases[index+1:]...)
+				return palletCase, nil
+			}
+		}
+	}
+	return Case{}, newError(ERR_STATE, "Case "+caseID+" is indexed on pallet "+palletID+" but not found there")
+}
+
+// takeUnit removes a unit from its case and returns it.
+func takeUnit(container *Container, caseID string, unitID string) (Unit, error) {
+	palletCase := findCase(container, caseID)
+	if palletCase != nil {
+		for index, unit := range palletCase.Units {
+			if unit.UnitId == unitID {
+				palletCase.Units = append(palletCase.Units[:index], palletCase.Units[index+1:]...)
+				return unit, nil
+			}
+		}
+	}
+	return Unit{}, newError(ERR_STATE, "Unit "+unitID+" is indexed in case "+caseID+" but not found there")
+}
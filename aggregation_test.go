@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSplitThenMergeLineage(t *testing.T) {
+	stub := newTestStub(t)
+	containerID := deliverTestContainer(t, stub, "B1")
+	pallets := stub.getContainer(t, containerID).Elements.Pallets
+	valAsbytes, err := stub.caller(ROLE_DISTRIBUTOR, "DIST").invoke("SplitContainer", containerID, `[["`+pallets[0].PalletId+`"]]`)
+	if err != nil {
+		t.Fatalf("SplitContainer: %v", err)
+	}
+	var childIDs []string
+	json.Unmarshal(valAsbytes, &childIDs)
+	mergedID, err := stub.invoke("MergeContainers", "", `[{"container_id":"`+childIDs[0]+`"},{"container_id":"`+containerID+`"}]`)
+	if err != nil {
+		t.Fatalf("MergeContainers: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		unitID      string
+		wantLineage []string
+	}{
+		{"split off then merged", pallets[0].Cases[0].Units[0].UnitId, []string{string(mergedID), childIDs[0], containerID}},
+		{"left behind then merged", pallets[1].Cases[1].Units[1].UnitId, []string{string(mergedID), containerID}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			valAsbytes, err := stub.query("GetUnitDetails", test.unitID)
+			if err != nil {
+				t.Fatalf("GetUnitDetails: %v", err)
+			}
+			details := UnitDetails{}
+			json.Unmarshal(valAsbytes, &details)
+			if details.ContainerId != string(mergedID) || details.Custodian != "DIST" {
+				t.Fatalf("unit is in %s with %s, want %s with DIST", details.ContainerId, details.Custodian, mergedID)
+			}
+			if !reflect.DeepEqual(details.ContainerLineage, test.wantLineage) {
+				t.Fatalf("got lineage %v, want %v", details.ContainerLineage, test.wantLineage)
+			}
+			supplychain := details.Provenance.Supplychain
+			if len(supplychain) == 0 || supplychain[0].Status != STATUS_SHIPPED || supplychain[len(supplychain)-1].Status != STATUS_MERGED {
+				t.Fatalf("history does not run from shipment to merge: %+v", supplychain)
+			}
+		})
+	}
+}
+
+func TestRepackValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		caller   string
+		function string
+		args     func(pallets []Pallet) []string
+		wantCode string
+	}{
+		{
+			name:     "case onto another pallet",
+			caller:   "DIST",
+			function: "MoveCases",
+			args: func(pallets []Pallet) []string {
+				return []string{pallets[1].PalletId, `["` + pallets[0].Cases[0].CaseId + `"]`}
+			}},
+		{
+			name:     "unit into another case",
+			caller:   "DIST",
+			function: "MoveUnits",
+			args: func(pallets []Pallet) []string {
+				return []string{pallets[1].Cases[0].CaseId, `["` + pallets[0].Cases[0].Units[0].UnitId + `"]`}
+			}},
+		{
+			name:     "not the custodian",
+			caller:   "PH",
+			function: "MoveUnits",
+			args: func(pallets []Pallet) []string {
+				return []string{pallets[1].Cases[0].CaseId, `["` + pallets[0].Cases[0].Units[0].UnitId + `"]`}
+			},
+			wantCode: ERR_FORBIDDEN},
+		{
+			name:     "case listed twice",
+			caller:   "DIST",
+			function: "MoveCases",
+			args: func(pallets []Pallet) []string {
+				return []string{pallets[1].PalletId, `["` + pallets[0].Cases[0].CaseId + `","` + pallets[0].Cases[0].CaseId + `"]`}
+			},
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "unit already in the target case",
+			caller:   "DIST",
+			function: "MoveUnits",
+			args: func(pallets []Pallet) []string {
+				return []string{pallets[0].Cases[0].CaseId, `["` + pallets[0].Cases[0].Units[0].UnitId + `"]`}
+			},
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "unknown unit",
+			caller:   "DIST",
+			function: "MoveUnits",
+			args: func(pallets []Pallet) []string {
+				return []string{pallets[1].Cases[0].CaseId, `["` + pallets[0].Cases[0].Units[0].UnitId + `","CON9PAL1CASE1UNIT1"]`}
+			},
+			wantCode: ERR_INVALID_ARGUMENT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			containerID := deliverTestContainer(t, stub, "B1")
+			pallets := stub.getContainer(t, containerID).Elements.Pallets
+			args := test.args(pallets)
+			_, err := stub.caller(ROLE_DISTRIBUTOR, test.caller).invoke(test.function, args...)
+			if code := errorCode(err); code != test.wantCode {
+				t.Fatalf("got %q (%v), want %q", code, err, test.wantCode)
+			}
+			if len(unitIDsOf(stub.getContainer(t, containerID))) != 8 {
+				t.Fatalf("repack changed the number of units in %s", containerID)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// STORAGE_RANGE_INDEX keys a StorageRange by drug ID.
+const STORAGE_RANGE_INDEX = "storage_range"
+
+// SENSOR_READING_INDEX keys a SensorReading by container, reading time and
+// sensor, so a range scan returns a container's readings in time order.
+const SENSOR_READING_INDEX = "container~reading"
+
+// LAST_READING_INDEX keys the time of the latest reading stored for a
+// container, so later calls cannot slip in older readings.
+const LAST_READING_INDEX = "container~last_reading"
+
+// EXCURSION_READING_INDEX keys a SensorReading of an excursion by the
+// excursion's container, drug and start, then reading time and sensor.
+const EXCURSION_READING_INDEX = "excursion~reading"
+
+// SENSOR_READING_TIME_LAYOUT is a fixed-width layout whose text order matches
+// time order.
+const SENSOR_READING_TIME_LAYOUT = "2006-01-02T15:04:05.000000000Z"
+
+// HEALTH_COMPROMISED marks a unit whose storage conditions left its drug's
+// StorageRange for longer than allowed.
+const HEALTH_COMPROMISED = "compromised"
+
+// StorageRange is the acceptable storage conditions for a drug. Humidity is
+// only checked when MaxHumidity is set. A drug is compromised once readings
+// stay out of range for longer than MaxExcursionMinutes; zero means any
+// out-of-range reading compromises it. RegisteredBy is the participant that
+// first stored the range.
+type StorageRange struct {
+	DrugId              string  `json:"drug_id"`
+	MinTemperature      float64 `json:"min_temperature"`
+	MaxTemperature      float64 `json:"max_temperature"`
+	MinHumidity         float64 `json:"min_humidity"`
+	MaxHumidity         float64 `json:"max_humidity"`
+	MaxExcursionMinutes int     `json:"max_excursion_minutes"`
+	RegisteredBy        string  `json:"registered_by"`
+}
+
+// SensorReading is one measurement taken inside a container. Temperature is
+// a pointer so that a reading without one is refused rather than read as 0.
+type SensorReading struct {
+	SensorId    string    `json:"sensor_id"`
+	Temperature *float64  `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+	ReadAt      time.Time `json:"read_at"`
+	RecordedBy  string    `json:"recorded_by"`
+	TxID        string    `json:"tx_id"`
+}
+
+// Excursion is a run of readings outside a drug's StorageRange. It stays open
+// until a reading back in range closes it. Its readings are kept under
+// EXCURSION_READING_INDEX for the container it started in.
+type Excursion struct {
+	ContainerId  string    `json:"container_id"`
+	DrugId       string    `json:"drug_id"`
+	StartedAt    time.Time `json:"started_at"`
+	EndedAt      time.Time `json:"ended_at"`
+	Open         bool      `json:"open"`
+	Compromised  bool      `json:"compromised"`
+	ReadingCount int       `json:"reading_count"`
+}
+
+// SetStorageRange creates or replaces the storage range of a drug. A regulator
+// or admin may set any range; a supplier only a range it registered itself.
+func (t *PharmaChaincode) SetStorageRange(stub shim.ChaincodeStubInterface, rangeJSON string) ([]byte, error) {
+	storageRange := StorageRange{}
+	err := json.Unmarshal([]byte(rangeJSON), &storageRange)
+	if err != nil {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "range_json", "Failed to parse storage range JSON: "+err.Error())
+	}
+	var violations []string
+	if storageRange.DrugId == "" {
+		violations = append(violations, "drug_id is required")
+	}
+	if storageRange.MinTemperature > storageRange.MaxTemperature {
+		violations = append(violations, "min_temperature is above max_temperature")
+	}
+	if storageRange.MaxHumidity != 0 && storageRange.MinHumidity > storageRange.MaxHumidity {
+		violations = append(violations, "min_humidity is above max_humidity")
+	}
+	if storageRange.MaxExcursionMinutes < 0 {
+		violations = append(violations, "max_excursion_minutes must not be negative")
+	}
+	if len(violations) > 0 {
+		rangeErr := newFieldError(ERR_INVALID_ARGUMENT, "range_json", "Storage range failed validation")
+		rangeErr.Violations = violations
+		return nil, rangeErr
+	}
+	fmt.Println("running SetStorageRange:" + storageRange.DrugId)
+	callerID, err := getCallerID(stub)
+	if err != nil {
+		return nil, err
+	}
+	role, err := getCallerRole(stub)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getStorageRange(stub, storageRange.DrugId)
+	if err != nil {
+		return nil, err
+	}
+	storageRange.RegisteredBy = callerID
+	if existing != nil {
+		storageRange.RegisteredBy = existing.RegisteredBy
+	}
+	if role == ROLE_SUPPLIER && storageRange.RegisteredBy != callerID {
+		return nil, newError(ERR_FORBIDDEN, "Storage range of "+storageRange.DrugId+" was registered by "+storageRange.RegisteredBy)
+	}
+	jsonVal, _ := json.Marshal(storageRange)
+	err = stub.PutState(createCompositeKey(STORAGE_RANGE_INDEX, []string{storageRange.DrugId}), jsonVal)
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to put state for storage range of "+storageRange.DrugId)
+	}
+	return nil, nil
+}
+
+// GetStorageRanges lists every stored storage range.
+func (t *PharmaChaincode) GetStorageRanges(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	keys, err := rangeCompositeKeys(stub, STORAGE_RANGE_INDEX, nil)
+	if err != nil {
+		return nil, err
+	}
+	ranges := []StorageRange{}
+	for _, key := range keys {
+		valAsbytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to get state for "+key)
+		}
+		storageRange := StorageRange{}
+		json.Unmarshal(valAsbytes, &storageRange)
+		ranges = append(ranges, storageRange)
+	}
+	jsonVal, _ := json.Marshal(ranges)
+	return jsonVal, nil
+}
+
+// RecordSensorReadings stores readings taken inside a container and checks them
+// against the storage range of every drug it holds. readingsJSON is a list of
+// {"sensor_id", "temperature", "humidity", "read_at"} objects in time order
+// with read_at in RFC 3339, none older than the container's latest stored
+// reading. Units of a drug whose excursion lasts longer than its range allows
+// are marked HEALTH_COMPROMISED.
+func (t *PharmaChaincode) RecordSensorReadings(stub shim.ChaincodeStubInterface, containerID string, readingsJSON string) ([]byte, error) {
+	fmt.Println("running RecordSensorReadings:" + containerID)
+	var readings []SensorReading
+	err := json.Unmarshal([]byte(readingsJSON), &readings)
+	if err != nil || len(readings) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "readings_json", "Expecting a non-empty list of sensor readings")
+	}
+	var violations []string
+	for index, reading := range readings {
+		if reading.SensorId == "" {
+			violations = append(violations, "reading "+strconv.Itoa(index)+": sensor_id is required")
+		}
+		if reading.Temperature == nil {
+			violations = append(violations, "reading "+strconv.Itoa(index)+": temperature is required")
+		}
+		if reading.ReadAt.IsZero() {
+			violations = append(violations, "reading "+strconv.Itoa(index)+": read_at is required")
+		} else if index > 0 && reading.ReadAt.Before(readings[index-1].ReadAt) {
+			violations = append(violations, "reading "+strconv.Itoa(index)+": read_at is earlier than the reading before it")
+		}
+	}
+	if len(violations) > 0 {
+		readingErr := newFieldError(ERR_INVALID_ARGUMENT, "readings_json", "Sensor readings failed validation")
+		readingErr.Violations = violations
+		return nil, readingErr
+	}
+
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, container.Custodian); err != nil {
+		return nil, err
+	}
+	lastKey := createCompositeKey(LAST_READING_INDEX, []string{containerID})
+	lastReadAt, err := stub.GetState(lastKey)
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to get state for latest sensor reading of container "+containerID)
+	}
+	keys := make([]string, len(readings))
+	for index, reading := range readings {
+		readAt := reading.ReadAt.UTC().Format(SENSOR_READING_TIME_LAYOUT)
+		keys[index] = createCompositeKey(SENSOR_READING_INDEX, []string{containerID, readAt, reading.SensorId})
+		if readAt < string(lastReadAt) {
+			violations = append(violations, "reading "+strconv.Itoa(index)+": read_at is earlier than the latest stored reading")
+			continue
+		}
+		existing, err := stub.GetState(keys[index])
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to get state for sensor reading of container "+containerID)
+		}
+		if len(existing) > 0 || (index > 0 && keys[index] == keys[index-1]) {
+			violations = append(violations, "reading "+strconv.Itoa(index)+": sensor "+reading.SensorId+" already has a reading at "+readAt)
+		}
+	}
+	if len(violations) > 0 {
+		readingErr := newFieldError(ERR_INVALID_ARGUMENT, "readings_json", "Sensor readings conflict with stored readings")
+		readingErr.Violations = violations
+		return nil, readingErr
+	}
+	ranges, err := getStorageRanges(stub, container)
+	if err != nil {
+		return nil, err
+	}
+
+	for index, reading := range readings {
+		reading.RecordedBy = container.Custodian
+		reading.TxID = stub.GetTxID()
+		jsonVal, _ := json.Marshal(reading)
+		err = stub.PutState(keys[index], jsonVal)
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to put state for sensor reading of container "+containerID)
+		}
+		for _, storageRange := range ranges {
+			if err = checkReading(stub, &container, storageRange, reading); err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = stub.PutState(lastKey, []byte(readings[len(readings)-1].ReadAt.UTC().Format(SENSOR_READING_TIME_LAYOUT)))
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to put state for latest sensor reading of container "+containerID)
+	}
+	err = putContainer(stub, container)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// GetSensorReadings lists the readings recorded for a container in time order.
+func (t *PharmaChaincode) GetSensorReadings(stub shim.ChaincodeStubInterface, containerID string) ([]byte, error) {
+	keys, err := rangeCompositeKeys(stub, SENSOR_READING_INDEX, []string{containerID})
+	if err != nil {
+		return nil, err
+	}
+	readings := []SensorReading{}
+	for _, key := range keys {
+		valAsbytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to get state for "+key)
+		}
+		reading := SensorReading{}
+		json.Unmarshal(valAsbytes, &reading)
+		readings = append(readings, reading)
+	}
+	jsonVal, _ := json.Marshal(readings)
+	return jsonVal, nil
+}
+
+// GetExcursionReadings lists the out-of-range readings of every excursion of
+// the drug in the container, in time order.
+func (t *PharmaChaincode) GetExcursionReadings(stub shim.ChaincodeStubInterface, containerID string, drugID string) ([]byte, error) {
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	readings := []SensorReading{}
+	for _, excursion := range container.Excursions {
+		if excursion.DrugId != drugID {
+			continue
+		}
+		keys, err := rangeCompositeKeys(stub, EXCURSION_READING_INDEX, []string{excursion.ContainerId, drugID, excursion.StartedAt.UTC().Format(SENSOR_READING_TIME_LAYOUT)})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			valAsbytes, err := stub.GetState(key)
+			if err != nil {
+				return nil, newError(ERR_STATE, "Failed to get state for "+key)
+			}
+			reading := SensorReading{}
+			json.Unmarshal(valAsbytes, &reading)
+			readings = append(readings, reading)
+		}
+	}
+	jsonVal, _ := json.Marshal(readings)
+	return jsonVal, nil
+}
+
+// checkReading opens, extends or closes the container's excursion for the
+// drug of storageRange, and marks the drug's units compromised once the
+// excursion has lasted too long.
+func checkReading(stub shim.ChaincodeStubInterface, container *Container, storageRange StorageRange, reading SensorReading) error {
+	var excursion *Excursion
+	for index := range container.Excursions {
+		if container.Excursions[index].DrugId == storageRange.DrugId && container.Excursions[index].Open {
+			excursion = &container.Excursions[index]
+		}
+	}
+	if inStorageRange(storageRange, reading) {
+		if excursion != nil {
+			excursion.Open = false
+			excursion.EndedAt = reading.ReadAt
+		}
+		return nil
+	}
+	if excursion == nil {
+		container.Excursions = append(container.Excursions, Excursion{
+			ContainerId: container.ContainerId,
+			DrugId:      storageRange.DrugId,
+			StartedAt:   reading.ReadAt,
+			Open:        true})
+		excursion = &container.Excursions[len(container.Excursions)-1]
+	}
+	jsonVal, _ := json.Marshal(reading)
+	key := createCompositeKey(EXCURSION_READING_INDEX, []string{
+		excursion.ContainerId,
+		excursion.DrugId,
+		excursion.StartedAt.UTC().Format(SENSOR_READING_TIME_LAYOUT),
+		reading.ReadAt.UTC().Format(SENSOR_READING_TIME_LAYOUT),
+		reading.SensorId})
+	if err := stub.PutState(key, jsonVal); err != nil {
+		return newError(ERR_STATE, "Failed to put state for excursion reading of container "+container.ContainerId)
+	}
+	excursion.ReadingCount++
+	excursion.EndedAt = reading.ReadAt
+	allowed := time.Duration(storageRange.MaxExcursionMinutes) * time.Minute
+	if !excursion.Compromised && excursion.EndedAt.Sub(excursion.StartedAt) >= allowed {
+		excursion.Compromised = true
+		markCompromised(container, storageRange.DrugId)
+	}
+	return nil
+}
+
+func inStorageRange(storageRange StorageRange, reading SensorReading) bool {
+	if *reading.Temperature < storageRange.MinTemperature || *reading.Temperature > storageRange.MaxTemperature {
+		return false
+	}
+	if storageRange.MaxHumidity != 0 && (reading.Humidity < storageRange.MinHumidity || reading.Humidity > storageRange.MaxHumidity) {
+		return false
+	}
+	return true
+}
+
+func markCompromised(container *Container, drugID string) {
+	for palletIndex := range container.Elements.Pallets {
+		pallet := &container.Elements.Pallets[palletIndex]
+		for caseIndex := range pallet.Cases {
+			palletCase := &pallet.Cases[caseIndex]
+			for unitIndex := range palletCase.Units {
+				if palletCase.Units[unitIndex].DrugId == drugID {
+					palletCase.Units[unitIndex].HealthStatus = HEALTH_COMPROMISED
+				}
+			}
+		}
+	}
+}
+
+// getStorageRanges returns the storage ranges of the drugs in the container,
+// in the order the drugs first appear. Drugs without a range are not checked.
+func getStorageRanges(stub shim.ChaincodeStubInterface, container Container) ([]StorageRange, error) {
+	var ranges []StorageRange
+	seen := make(map[string]bool)
+	for _, pallet := range container.Elements.Pallets {
+		for _, palletCase := range pallet.Cases {
+			for _, unit := range palletCase.Units {
+				if seen[unit.DrugId] {
+					continue
+				}
+				seen[unit.DrugId] = true
+				storageRange, err := getStorageRange(stub, unit.DrugId)
+				if err != nil {
+					return nil, err
+				}
+				if storageRange != nil {
+					ranges = append(ranges, *storageRange)
+				}
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// getStorageRange returns the storage range of a drug, or nil when it has none.
+func getStorageRange(stub shim.ChaincodeStubInterface, drugID string) (*StorageRange, error) {
+	valAsbytes, err := stub.GetState(createCompositeKey(STORAGE_RANGE_INDEX, []string{drugID}))
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to get state for storage range of "+drugID)
+	}
+	if len(valAsbytes) == 0 {
+		return nil, nil
+	}
+	storageRange := StorageRange{}
+	json.Unmarshal(valAsbytes, &storageRange)
+	return &storageRange, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// DESTRUCTION_INDEX keys a Destruction by container and transaction, so a
+// range scan returns every destruction recorded against a container.
+const DESTRUCTION_INDEX = "container~destruction"
+
+// SERIAL_DESTROYED retires the serial of a destroyed element for good.
+const SERIAL_DESTROYED = "destroyed"
+
+// STATUS_UNITS_DESTROYED marks the destruction of some units of a container.
+// It is never a transit status.
+const STATUS_UNITS_DESTROYED = "units_destroyed"
+
+// Destruction is the evidence that stock was disposed of: where, how, who
+// witnessed it and the hash of the destruction certificate kept off-chain.
+type Destruction struct {
+	ContainerId     string    `json:"container_id"`
+	UnitIds         []string  `json:"unit_ids"`
+	Facility        string    `json:"facility"`
+	Method          string    `json:"method"`
+	Witness         string    `json:"witness"`
+	CertificateHash string    `json:"certificate_hash"`
+	Remarks         string    `json:"remarks,omitempty"`
+	DestroyedBy     string    `json:"destroyed_by"`
+	DestroyedAt     time.Time `json:"destroyed_at"`
+	TxID            string    `json:"tx_id"`
+}
+
+// DestroyContainer records the destruction of a whole container held by the
+// caller and permanently retires its serials. destructionJSON carries the
+// facility, method, witness and certificate_hash of the disposal.
+func (t *PharmaChaincode) DestroyContainer(stub shim.ChaincodeStubInterface, containerID string, destructionJSON string) ([]byte, error) {
+	fmt.Println("running DestroyContainer:" + containerID)
+	destruction, err := parseDestruction(destructionJSON)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, container.Custodian); err != nil {
+		return nil, err
+	}
+	if err = checkTransition(container, STATUS_DESTROYED); err != nil {
+		return nil, err
+	}
+	if err = checkReturnedToOrigin(container); err != nil {
+		return nil, err
+	}
+	return nil, destroyContainer(stub, &container, destruction)
+}
+
+// destroyContainer retires every pallet, case and live unit of the container
+// and closes it out as STATUS_DESTROYED.
+func destroyContainer(stub shim.ChaincodeStubInterface, container *Container, destruction Destruction) error {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	for palletIndex := range container.Elements.Pallets {
+		pallet := &container.Elements.Pallets[palletIndex]
+		if err = retireSerial(stub, ELEMENT_PALLET, pallet.PalletId, container.ContainerId, SERIAL_DESTROYED, container.Custodian, txTime); err != nil {
+			return err
+		}
+		for caseIndex := range pallet.Cases {
+			palletCase := &pallet.Cases[caseIndex]
+			if err = retireSerial(stub, ELEMENT_CASE, palletCase.CaseId, container.ContainerId, SERIAL_DESTROYED, container.Custodian, txTime); err != nil {
+				return err
+			}
+			for unitIndex := range palletCase.Units {
+				unit := &palletCase.Units[unitIndex]
+				if unitRetired(*unit) {
+					continue
+				}
+				if err = destroyUnit(stub, container, unit, txTime); err != nil {
+					return err
+				}
+				destruction.UnitIds = append(destruction.UnitIds, unit.UnitId)
+			}
+		}
+	}
+	chainActivity, err := newChainActivity(stub, container.Custodian, destruction.Facility, STATUS_DESTROYED)
+	if err != nil {
+		return err
+	}
+	chainActivity.Remarks = destruction.Remarks
+	container.Provenance.Supplychain = append(container.Provenance.Supplychain, chainActivity)
+	container.Provenance.TransitStatus = STATUS_DESTROYED
+	container.ReturnTo = ""
+	if err = putDestruction(stub, *container, destruction, txTime); err != nil {
+		return err
+	}
+	if err = releaseCustody(stub, container); err != nil {
+		return err
+	}
+	return putContainer(stub, *container)
+}
+
+// DestroyUnits records the destruction of some units of a container held by
+// the caller and permanently retires their serials. The container must be one
+// that could itself be destroyed: not in transit and, if rejected, back with
+// its origin.
+func (t *PharmaChaincode) DestroyUnits(stub shim.ChaincodeStubInterface, containerID string, unitIDsJSON string, destructionJSON string) ([]byte, error) {
+	fmt.Println("running DestroyUnits:" + containerID)
+	var unitIDs []string
+	err := json.Unmarshal([]byte(unitIDsJSON), &unitIDs)
+	if err != nil || len(unitIDs) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "unit_ids_json", "Expecting a non-empty list of unit IDs")
+	}
+	destruction, err := parseDestruction(destructionJSON)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, container.Custodian); err != nil {
+		return nil, err
+	}
+	if err = checkTransition(container, STATUS_DESTROYED); err != nil {
+		return nil, err
+	}
+	if err = checkReturnedToOrigin(container); err != nil {
+		return nil, err
+	}
+
+	var violations []string
+	listed := make(map[string]bool)
+	for _, unitID := range unitIDs {
+		_, _, unit := findUnit(container, unitID)
+		if unit == nil {
+			violations = append(violations, "unit "+unitID+" is not in container "+containerID)
+		} else if listed[unitID] {
+			violations = append(violations, "unit "+unitID+" is listed more than once")
+		} else if unitRetired(*unit) {
+			violations = append(violations, "unit "+unitID+" has already left the supply chain")
+		}
+		listed[unitID] = true
+	}
+	if len(violations) > 0 {
+		destroyErr := newFieldError(ERR_INVALID_ARGUMENT, "unit_ids_json", "Units cannot be destroyed")
+		destroyErr.Violations = violations
+		return nil, destroyErr
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, unitID := range unitIDs {
+		_, _, unit := findUnit(container, unitID)
+		if err = destroyUnit(stub, &container, unit, txTime); err != nil {
+			return nil, err
+		}
+	}
+	destruction.UnitIds = unitIDs
+	chainActivity, err := newChainActivity(stub, container.Custodian, destruction.Facility, STATUS_UNITS_DESTROYED)
+	if err != nil {
+		return nil, err
+	}
+	chainActivity.Remarks = destruction.Remarks
+	container.Provenance.Supplychain = append(container.Provenance.Supplychain, chainActivity)
+	if err = putDestruction(stub, container, destruction, txTime); err != nil {
+		return nil, err
+	}
+	if err = putContainer(stub, container); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// GetDestructions lists the destructions recorded against a container.
+func (t *PharmaChaincode) GetDestructions(stub shim.ChaincodeStubInterface, containerID string) ([]byte, error) {
+	keys, err := rangeCompositeKeys(stub, DESTRUCTION_INDEX, []string{containerID})
+	if err != nil {
+		return nil, err
+	}
+	destructions := []Destruction{}
+	for _, key := range keys {
+		valAsbytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to get state for "+key)
+		}
+		destruction := Destruction{}
+		json.Unmarshal(valAsbytes, &destruction)
+		destructions = append(destructions, destruction)
+	}
+	jsonVal, _ := json.Marshal(destructions)
+	return jsonVal, nil
+}
+
+// unitRetired reports whether a unit has left the supply chain, by sale or
+// destruction. A retired unit stays in its container as a record only.
+func unitRetired(unit Unit) bool {
+	return unit.SaleStatus == SALE_STATUS_SOLD || unit.DestructionTxID != ""
+}
+
+func destroyUnit(stub shim.ChaincodeStubInterface, container *Container, unit *Unit, txTime time.Time) error {
+	unit.DestructionTxID = stub.GetTxID()
+	return retireSerial(stub, ELEMENT_UNIT, unit.UnitId, container.ContainerId, SERIAL_DESTROYED, container.Custodian, txTime)
+}
+
+func parseDestruction(destructionJSON string) (Destruction, error) {
+	destruction := Destruction{}
+	err := json.Unmarshal([]byte(destructionJSON), &destruction)
+	if err != nil {
+		return destruction, newFieldError(ERR_INVALID_ARGUMENT, "destruction_json", "Failed to parse destruction JSON: "+err.Error())
+	}
+	var violations []string
+	if destruction.Facility == "" {
+		violations = append(violations, "facility is required")
+	}
+	if destruction.Method == "" {
+		violations = append(violations, "method is required")
+	}
+	if destruction.Witness == "" {
+		violations = append(violations, "witness is required")
+	}
+	if decoded, err := hex.DecodeString(destruction.CertificateHash); err != nil || len(decoded) != sha256.Size {
+		violations = append(violations, "certificate_hash must be a hex encoded SHA-256 digest")
+	}
+	if len(violations) > 0 {
+		destructionErr := newFieldError(ERR_INVALID_ARGUMENT, "destruction_json", "Destruction failed validation")
+		destructionErr.Violations = violations
+		return destruction, destructionErr
+	}
+	destruction.CertificateHash = strings.ToLower(destruction.CertificateHash)
+	return destruction, nil
+}
+
+func putDestruction(stub shim.ChaincodeStubInterface, container Container, destruction Destruction, txTime time.Time) error {
+	destruction.ContainerId = container.ContainerId
+	destruction.DestroyedBy = container.Custodian
+	destruction.DestroyedAt = txTime
+	destruction.TxID = stub.GetTxID()
+	jsonVal, _ := json.Marshal(destruction)
+	err := stub.PutState(createCompositeKey(DESTRUCTION_INDEX, []string{container.ContainerId, destruction.TxID}), jsonVal)
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for destruction of container "+container.ContainerId)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDestroyContainer(t *testing.T) {
+	tests := []struct {
+		name        string
+		delivered   bool
+		caller      string
+		destruction string
+		wantCode    string
+	}{
+		{"custodian destroys", true, "DIST", TEST_DESTRUCTION, ""},
+		{"not the custodian", true, "SUP", TEST_DESTRUCTION, ERR_FORBIDDEN},
+		{"in transit", false, "SUP", TEST_DESTRUCTION, ERR_INVALID_TRANSITION},
+		{"no witness", true, "DIST", strings.Replace(TEST_DESTRUCTION, `"W1"`, `""`, 1), ERR_INVALID_ARGUMENT},
+		{"certificate not a digest", true, "DIST", strings.Replace(TEST_DESTRUCTION, "9f86", "zz86", 1), ERR_INVALID_ARGUMENT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			var containerID string
+			if test.delivered {
+				containerID = deliverTestContainer(t, stub, "B1")
+			} else {
+				containerID = shipTestContainer(t, stub, "B1")
+			}
+			_, err := stub.caller(ROLE_DISTRIBUTOR, test.caller).invoke("DestroyContainer", containerID, test.destruction)
+			if code := errorCode(err); code != test.wantCode {
+				t.Fatalf("got %q (%v), want %q", code, err, test.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			container := stub.getContainer(t, containerID)
+			if container.Provenance.TransitStatus != STATUS_DESTROYED || container.Custodian != "" {
+				t.Fatalf("got %s with %q, want %s with no custodian", container.Provenance.TransitStatus, container.Custodian, STATUS_DESTROYED)
+			}
+			for _, unitID := range unitIDsOf(container) {
+				serial, err := getSerial(stub, unitID)
+				if err != nil || serial == nil || serial.Status != SERIAL_DESTROYED {
+					t.Fatalf("serial of %s: %+v %v", unitID, serial, err)
+				}
+			}
+			_, err = stub.caller(ROLE_DISTRIBUTOR, test.caller).invoke("DestroyContainer", containerID, test.destruction)
+			if errorCode(err) != ERR_FORBIDDEN {
+				t.Fatalf("destroyed twice: %v", err)
+			}
+		})
+	}
+}
+
+func TestDestroyUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		unitIDs  func(unitIDs []string) string
+		wantCode string
+	}{
+		{
+			name:    "units of the container",
+			unitIDs: func(unitIDs []string) string { return `["` + unitIDs[0] + `","` + unitIDs[3] + `"]` }},
+		{
+			name:     "empty list",
+			unitIDs:  func(unitIDs []string) string { return `[]` },
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "unit of another container",
+			unitIDs:  func(unitIDs []string) string { return `["` + unitIDs[0] + `","CON9PAL1CASE1UNIT1"]` },
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "unit listed twice",
+			unitIDs:  func(unitIDs []string) string { return `["` + unitIDs[0] + `","` + unitIDs[0] + `"]` },
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "unit already destroyed",
+			unitIDs:  func(unitIDs []string) string { return `["` + unitIDs[7] + `"]` },
+			wantCode: ERR_INVALID_ARGUMENT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			containerID := deliverTestContainer(t, stub, "B1")
+			unitIDs := unitIDsOf(stub.getContainer(t, containerID))
+			runSteps(t, stub, []step{
+				{ROLE_DISTRIBUTOR, "DIST", "DestroyUnits", []string{containerID, `["` + unitIDs[7] + `"]`, TEST_DESTRUCTION}, ""},
+				{ROLE_DISTRIBUTOR, "DIST", "DestroyUnits", []string{containerID, test.unitIDs(unitIDs), TEST_DESTRUCTION}, test.wantCode},
+			})
+			container := stub.getContainer(t, containerID)
+			if container.Provenance.TransitStatus != STATUS_ACCEPTED || container.Custodian != "DIST" {
+				t.Fatalf("got %s with %s, want the container still accepted by DIST", container.Provenance.TransitStatus, container.Custodian)
+			}
+			valAsbytes, err := stub.query("VerifyUnit", unitIDs[7])
+			if err != nil || !strings.Contains(string(valAsbytes), VERDICT_SUSPECT) {
+				t.Fatalf("destroyed unit verified as %s %v", valAsbytes, err)
+			}
+		})
+	}
+}
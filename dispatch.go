@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Error codes carried in ChaincodeError.Code.
+const ERR_UNKNOWN_FUNCTION = "UNKNOWN_FUNCTION"
+const ERR_ARGUMENT_COUNT = "ARGUMENT_COUNT"
+const ERR_MISSING_ARGUMENT = "MISSING_ARGUMENT"
+const ERR_INVALID_ARGUMENT = "INVALID_ARGUMENT"
+const ERR_FORBIDDEN = "FORBIDDEN"
+const ERR_NOT_FOUND = "NOT_FOUND"
+const ERR_INVALID_TRANSITION = "INVALID_TRANSITION"
+const ERR_EXPIRED = "EXPIRED"
+const ERR_DUPLICATE_SERIAL = "DUPLICATE_SERIAL"
+const ERR_SUSPECT_SERIAL = "SUSPECT_SERIAL"
+const ERR_STATE = "STATE_ERROR"
+const ERR_INTERNAL = "INTERNAL"
+
+// ChaincodeError is the error payload returned to clients. Error renders it as
+// JSON so the client SDK can parse the response message directly.
+type ChaincodeError struct {
+	Code       string   `json:"code"`
+	Message    string   `json:"message"`
+	Function   string   `json:"function,omitempty"`
+	Field      string   `json:"field,omitempty"`
+	Violations []string `json:"violations,omitempty"`
+}
+
+func (e *ChaincodeError) Error() string {
+	jsonVal, _ := json.Marshal(e)
+	return string(jsonVal)
+}
+
+func newError(code string, message string) *ChaincodeError {
+	return &ChaincodeError{Code: code, Message: message}
+}
+
+func newFieldError(code string, field string, message string) *ChaincodeError {
+	return &ChaincodeError{Code: code, Message: message, Field: field}
+}
+
+// argSpec describes one positional argument of a chaincode function.
+type argSpec struct {
+	Name     string
+	Optional bool // may be passed as an empty string, or left off the end
+}
+
+type handlerFunc func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+
+// functionSpec declares a chaincode function: its arguments, the roles allowed
+// to call it and the handler run once both have been checked.
+type functionSpec struct {
+	Args    []argSpec
+	Roles   []string
+	Handler handlerFunc
+}
+
+var invokeFunctions = map[string]functionSpec{
+	"ShipContainerUsingLogistics": {
+		Args:  []argSpec{{Name: "sender_id"}, {Name: "logistics_id"}, {Name: "receiver_id"}, {Name: "remarks", Optional: true}, {Name: "elements_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.ShipContainerUsingLogistics(stub, args[0], args[1], args[2], args[3], args[4])
+		}},
+	"SetCurrentOwner": {
+		Args:  []argSpec{{Name: "owner_id"}, {Name: "container_id"}},
+		Roles: []string{ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.SetCurrentOwnerTest(stub, args[0], args[1])
+		}},
+	"AcceptContainerbyLogistics": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "logistics_id"}, {Name: "receiver_id"}, {Name: "remarks", Optional: true}},
+		Roles: []string{ROLE_LOGISTICS},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.AcceptContainerbyLogistics(stub, args[0], args[1], args[2], args[3])
+		}},
+	"DispatchContainer": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "receiver_id"}, {Name: "remarks", Optional: true}},
+		Roles: []string{ROLE_LOGISTICS},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.DispatchContainer(stub, args[0], args[1], args[2])
+		}},
+	"AcceptContainerbyDistributor": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "receiver_id"}, {Name: "remarks", Optional: true}},
+		Roles: []string{ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.AcceptContainerbyDistributor(stub, args[0], args[1], args[2])
+		}},
+	"RejectContainerbyLogistics": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "logistics_id"}, {Name: "receiver_id"}, {Name: "remarks"}, {Name: "reason_code"}},
+		Roles: []string{ROLE_LOGISTICS},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.RejectContainerbyLogistics(stub, args[0], args[1], args[2], args[3], args[4])
+		}},
+	"PartiallyAcceptContainerbyDistributor": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "receiver_id"}, {Name: "rejections_json"}},
+		Roles: []string{ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.PartiallyAcceptContainerbyDistributor(stub, args[0], args[1], args[2])
+		}},
+	"RejectContainerbyDistributor": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "receiver_id"}, {Name: "remarks"}, {Name: "reason_code"}},
+		Roles: []string{ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.RejectContainerbyDistributor(stub, args[0], args[1], args[2], args[3])
+		}},
+	"InitiateReturn": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "logistics_id"}, {Name: "remarks", Optional: true}},
+		Roles: []string{ROLE_LOGISTICS, ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.InitiateReturn(stub, args[0], args[1], args[2])
+		}},
+	"ShipReturn": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "logistics_id"}},
+		Roles: []string{ROLE_LOGISTICS},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.ShipReturn(stub, args[0], args[1])
+		}},
+	"ReceiveReturn": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "receiver_id"}, {Name: "remarks", Optional: true}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.ReceiveReturn(stub, args[0], args[1], args[2])
+		}},
+	"DisposeReturn": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "disposition"}, {Name: "remarks", Optional: true}, {Name: "destruction_json", Optional: true}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.DisposeReturn(stub, args[0], args[1], args[2], args[3])
+		}},
+	"DestroyContainer": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "destruction_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.DestroyContainer(stub, args[0], args[1])
+		}},
+	"DestroyUnits": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "unit_ids_json"}, {Name: "destruction_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.DestroyUnits(stub, args[0], args[1], args[2])
+		}},
+	"SplitContainer": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "split_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.SplitContainer(stub, args[0], args[1])
+		}},
+	"MergeContainers": {
+		Args:  []argSpec{{Name: "target_container_id", Optional: true}, {Name: "merge_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.MergeContainers(stub, args[0], args[1])
+		}},
+	"MoveCases": {
+		Args:  []argSpec{{Name: "target_pallet_id"}, {Name: "case_ids_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.MoveCases(stub, args[0], args[1])
+		}},
+	"MoveUnits": {
+		Args:  []argSpec{{Name: "target_case_id"}, {Name: "unit_ids_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.MoveUnits(stub, args[0], args[1])
+		}},
+	"InitiateRecall": {
+		Args:  []argSpec{{Name: "recall_id"}, {Name: "batch_number"}, {Name: "lot_number", Optional: true}, {Name: "reason"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_REGULATOR},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.InitiateRecall(stub, args[0], args[1], args[2], args[3])
+		}},
+	"AcknowledgeRecall": {
+		Args:  []argSpec{{Name: "recall_id"}, {Name: "container_id"}, {Name: "remarks", Optional: true}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.AcknowledgeRecall(stub, args[0], args[1], args[2])
+		}},
+	"SetExpiryWindow": {
+		Args:  []argSpec{{Name: "days"}},
+		Roles: []string{ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.SetExpiryWindow(stub, args[0])
+		}},
+	"SetStorageRange": {
+		Args:  []argSpec{{Name: "range_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_REGULATOR, ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.SetStorageRange(stub, args[0])
+		}},
+	"RecordSensorReadings": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "readings_json"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_LOGISTICS, ROLE_DISTRIBUTOR, ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.RecordSensorReadings(stub, args[0], args[1])
+		}},
+	"DispenseUnit": {
+		Args:  []argSpec{{Name: "unit_id"}, {Name: "consumer_commitment", Optional: true}},
+		Roles: []string{ROLE_PHARMACY},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.DispenseUnit(stub, args[0], args[1])
+		}},
+	"ReserveContainer": {
+		Args:  []argSpec{{Name: "template_name", Optional: true}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.ReserveContainer(stub, args[0])
+		}},
+	"SetPackagingTemplate": {
+		Args:  []argSpec{{Name: "template_json"}},
+		Roles: []string{ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.SetPackagingTemplate(stub, args[0])
+		}},
+	"DeletePackagingTemplate": {
+		Args:  []argSpec{{Name: "template_name"}},
+		Roles: []string{ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.DeletePackagingTemplate(stub, args[0])
+		}},
+	"MigrateContainerOwners": {
+		Roles: []string{ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.MigrateContainerOwners(stub)
+		}},
+}
+
+var queryFunctions = map[string]functionSpec{
+	"GetContainerDetails": {
+		Args:  []argSpec{{Name: "container_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetContainerDetails(stub, args[0])
+		}},
+	"GetMaxIDValue": {
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR, ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetMaxIDValue(stub)
+		}},
+	"GetEmptyContainer": {
+		Args:  []argSpec{{Name: "template_name", Optional: true}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR, ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetEmptyContainer(stub, args[0])
+		}},
+	"GetPackagingTemplates": {
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetPackagingTemplates(stub)
+		}},
+	"GetReservation": {
+		Args:  []argSpec{{Name: "container_id"}},
+		Roles: []string{ROLE_SUPPLIER, ROLE_DISTRIBUTOR, ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetReservation(stub, args[0])
+		}},
+	"GetUnitDetails": {
+		Args:  []argSpec{{Name: "unit_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetUnitDetails(stub, args[0])
+		}},
+	"GetRecall": {
+		Args:  []argSpec{{Name: "recall_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetRecall(stub, args[0])
+		}},
+	"GetRecallExposure": {
+		Args:  []argSpec{{Name: "recall_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetRecallExposure(stub, args[0])
+		}},
+	"GetExpiringUnits": {
+		Args:  []argSpec{{Name: "custodian_id"}, {Name: "days"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetExpiringUnits(stub, args[0], args[1])
+		}},
+	"GetStorageRanges": {
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetStorageRanges(stub)
+		}},
+	"GetSensorReadings": {
+		Args:  []argSpec{{Name: "container_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetSensorReadings(stub, args[0])
+		}},
+	"GetExcursionReadings": {
+		Args:  []argSpec{{Name: "container_id"}, {Name: "drug_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetExcursionReadings(stub, args[0], args[1])
+		}},
+	"GetDestructions": {
+		Args:  []argSpec{{Name: "container_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetDestructions(stub, args[0])
+		}},
+	"GetRejections": {
+		Args:  []argSpec{{Name: "reason_code", Optional: true}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetRejections(stub, args[0])
+		}},
+	"VerifyUnit": {
+		Args:  []argSpec{{Name: "unit_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.VerifyUnit(stub, args[0])
+		}},
+	"VerifyConsumer": {
+		Args:  []argSpec{{Name: "unit_id"}, {Name: "consumer_id"}, {Name: "salt"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.VerifyConsumer(stub, args[0], args[1], args[2])
+		}},
+	"GetContainerDetailsForOwner": {
+		Args:  []argSpec{{Name: "owner_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetContainerDetailsForOwner(stub, args[0])
+		}},
+	"GetContainerDetailsForCustodian": {
+		Args:  []argSpec{{Name: "custodian_id"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetContainerDetailsForCustodian(stub, args[0])
+		}},
+	"GetOwner": {
+		Roles: []string{ROLE_REGULATOR, ROLE_ADMIN},
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetOwner(stub)
+		}},
+	"GetUserAttribute": {
+		Args:  []argSpec{{Name: "attribute_name"}},
+		Roles: allRoles,
+		Handler: func(t *PharmaChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return t.GetUserAttribute(stub, args[0])
+		}},
+}
+
+// dispatch looks function up in functions, validates args and the caller's
+// role against its spec and runs its handler. Every error returned is a
+// *ChaincodeError naming the function.
+func (t *PharmaChaincode) dispatch(stub shim.ChaincodeStubInterface, functions map[string]functionSpec, function string, args []string) ([]byte, error) {
+	spec, ok := functions[function]
+	if !ok {
+		fmt.Println("dispatch did not find func: " + function)
+		return nil, &ChaincodeError{Code: ERR_UNKNOWN_FUNCTION, Message: "Received unknown function " + function, Function: function}
+	}
+	args, err := checkArgs(spec.Args, args)
+	if err == nil {
+		err = checkRole(stub, function, spec.Roles)
+	}
+	var result []byte
+	if err == nil {
+		result, err = spec.Handler(t, stub, args)
+	}
+	if err != nil {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok {
+			chaincodeErr = newError(ERR_INTERNAL, err.Error())
+		}
+		chaincodeErr.Function = function
+		return nil, chaincodeErr
+	}
+	return result, nil
+}
+
+// checkArgs validates args against the declared argument list. Trailing
+// optional arguments may be omitted; the returned slice has them filled in
+// as empty strings.
+func checkArgs(specs []argSpec, args []string) ([]string, error) {
+	required := len(specs)
+	for required > 0 && specs[required-1].Optional {
+		required--
+	}
+	if len(args) < required || len(args) > len(specs) {
+		names := make([]string, len(specs))
+		for index, spec := range specs {
+			names[index] = spec.Name
+		}
+		return nil, newError(ERR_ARGUMENT_COUNT, "Expecting "+strconv.Itoa(len(specs))+" arguments ("+strings.Join(names, ", ")+"), got "+strconv.Itoa(len(args)))
+	}
+	for len(args) < len(specs) {
+		args = append(args, "")
+	}
+	for index, spec := range specs {
+		if !spec.Optional && args[index] == "" {
+			return nil, newFieldError(ERR_MISSING_ARGUMENT, spec.Name, "Argument "+spec.Name+" must not be empty")
+		}
+	}
+	return args, nil
+}
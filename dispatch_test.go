@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckArgs(t *testing.T) {
+	specs := []argSpec{{Name: "container_id"}, {Name: "receiver_id"}, {Name: "remarks", Optional: true}}
+	tests := []struct {
+		name      string
+		args      []string
+		wantArgs  []string
+		wantCode  string
+		wantField string
+	}{
+		{"all arguments", []string{"CON1", "DIST", "ok"}, []string{"CON1", "DIST", "ok"}, "", ""},
+		{"optional left off", []string{"CON1", "DIST"}, []string{"CON1", "DIST", ""}, "", ""},
+		{"optional empty", []string{"CON1", "DIST", ""}, []string{"CON1", "DIST", ""}, "", ""},
+		{"too few", []string{"CON1"}, nil, ERR_ARGUMENT_COUNT, ""},
+		{"too many", []string{"CON1", "DIST", "ok", "extra"}, nil, ERR_ARGUMENT_COUNT, ""},
+		{"required empty", []string{"CON1", "", "ok"}, nil, ERR_MISSING_ARGUMENT, "receiver_id"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := checkArgs(specs, test.args)
+			if code := errorCode(err); code != test.wantCode {
+				t.Fatalf("got %q (%v), want %q", code, err, test.wantCode)
+			}
+			if err != nil {
+				if field := err.(*ChaincodeError).Field; field != test.wantField {
+					t.Fatalf("got field %q, want %q", field, test.wantField)
+				}
+				return
+			}
+			if !reflect.DeepEqual(args, test.wantArgs) {
+				t.Fatalf("got %q, want %q", args, test.wantArgs)
+			}
+		})
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		function string
+		args     []string
+		wantCode string
+	}{
+		{"unknown function", ROLE_ADMIN, "NoSuchFunction", nil, ERR_UNKNOWN_FUNCTION},
+		{"argument count checked before role", ROLE_PHARMACY, "SetExpiryWindow", nil, ERR_ARGUMENT_COUNT},
+		{"role not allowed", ROLE_PHARMACY, "SetExpiryWindow", []string{"30"}, ERR_FORBIDDEN},
+		{"role allowed", ROLE_ADMIN, "SetExpiryWindow", []string{"30"}, ""},
+		{"query function not invocable", ROLE_ADMIN, "GetOwner", nil, ERR_UNKNOWN_FUNCTION},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			_, err := stub.caller(test.role, "P1").invoke(test.function, test.args...)
+			if code := errorCode(err); code != test.wantCode {
+				t.Fatalf("got %q (%v), want %q", code, err, test.wantCode)
+			}
+			if err != nil && err.(*ChaincodeError).Function != test.function {
+				t.Fatalf("error does not name %s: %v", test.function, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SALE_STATUS_SOLD marks a unit dispensed to a consumer. A sold unit stays in
+// its container as a record but takes no further part in the supply chain.
+const SALE_STATUS_SOLD = "sold"
+
+// DispenseUnit records the sale of a unit by the pharmacy holding it. The unit
+// must not be expired, recalled, compromised or already sold.
+//
+// The consumer is never named on the ledger. The pharmacy instead passes a
+// commitment, the hex SHA-256 of a secret salt, ":" and the consumer
+// identifier, and keeps the salt off-chain; see VerifyConsumer.
+func (t *PharmaChaincode) DispenseUnit(stub shim.ChaincodeStubInterface, unitID string, consumerCommitment string) ([]byte, error) {
+	fmt.Println("running DispenseUnit:" + unitID)
+	if consumerCommitment != "" {
+		decoded, err := hex.DecodeString(consumerCommitment)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, newFieldError(ERR_INVALID_ARGUMENT, "consumer_commitment", "Expecting a hex encoded SHA-256 digest")
+		}
+	}
+	location, err := getElementLocation(stub, ELEMENT_UNIT, unitID)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getContainer(stub, location.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, container.Custodian); err != nil {
+		return nil, err
+	}
+	if container.Provenance.TransitStatus != STATUS_ACCEPTED {
+		return nil, newError(ERR_INVALID_TRANSITION, "Units of container "+container.ContainerId+" cannot be dispensed while "+container.Provenance.TransitStatus)
+	}
+	_, _, unit := findUnit(container, unitID)
+	if unit == nil {
+		return nil, newError(ERR_STATE, "Unit "+unitID+" is indexed in container "+container.ContainerId+" but not found there")
+	}
+
+	today, err := expiryCutoff(stub, 0)
+	if err != nil {
+		return nil, err
+	}
+	var violations []string
+	if unit.SaleStatus == SALE_STATUS_SOLD {
+		violations = append(violations, "unit "+unitID+" has already been sold")
+	}
+	if unit.DestructionTxID != "" {
+		violations = append(violations, "unit "+unitID+" has been destroyed")
+	}
+	if unit.RecallId != "" {
+		violations = append(violations, "unit "+unitID+" is recalled under "+unit.RecallId)
+	}
+	if unit.HealthStatus == HEALTH_COMPROMISED {
+		violations = append(violations, "unit "+unitID+" is compromised")
+	}
+	if !unit.ExpiryDate.IsZero() && unit.ExpiryDate.Before(today) {
+		violations = append(violations, "unit "+unitID+" expired "+unit.ExpiryDate.String())
+	}
+	if len(violations) > 0 {
+		dispenseErr := newFieldError(ERR_INVALID_ARGUMENT, "unit_id", "Unit "+unitID+" cannot be dispensed")
+		dispenseErr.Violations = violations
+		return nil, dispenseErr
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	unit.SaleStatus = SALE_STATUS_SOLD
+	unit.ConsumerCommitment = strings.ToLower(consumerCommitment)
+	unit.DispensedBy = container.Custodian
+	unit.DispensedAt = &txTime
+	unit.DispenseTxID = stub.GetTxID()
+	if err = putContainer(stub, container); err != nil {
+		return nil, err
+	}
+	if err = retireSerial(stub, ELEMENT_UNIT, unitID, container.ContainerId, SERIAL_DISPENSED, container.Custodian, txTime); err != nil {
+		return nil, err
+	}
+	jsonVal, _ := json.Marshal(unit)
+	return jsonVal, nil
+}
+
+// ConsumerVerification is the answer of VerifyConsumer.
+type ConsumerVerification struct {
+	UnitId  string `json:"unit_id"`
+	Matches bool   `json:"matches"`
+}
+
+// VerifyConsumer confirms whether the unit was dispensed to the consumer
+// identified by consumerID and salt, without the ledger holding either.
+func (t *PharmaChaincode) VerifyConsumer(stub shim.ChaincodeStubInterface, unitID string, consumerID string, salt string) ([]byte, error) {
+	location, err := getElementLocation(stub, ELEMENT_UNIT, unitID)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getContainer(stub, location.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+	_, _, unit := findUnit(container, unitID)
+	if unit == nil {
+		return nil, newError(ERR_STATE, "Unit "+unitID+" is indexed in container "+container.ContainerId+" but not found there")
+	}
+	if unit.SaleStatus != SALE_STATUS_SOLD {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "unit_id", "Unit "+unitID+" has not been dispensed")
+	}
+	verification := ConsumerVerification{UnitId: unitID}
+	if unit.ConsumerCommitment != "" {
+		commitment := consumerCommitment(consumerID, salt)
+		verification.Matches = subtle.ConstantTimeCompare([]byte(commitment), []byte(unit.ConsumerCommitment)) == 1
+	}
+	jsonVal, _ := json.Marshal(verification)
+	return jsonVal, nil
+}
+
+// consumerCommitment is the hex SHA-256 of salt, ":" and consumerID.
+func consumerCommitment(consumerID string, salt string) string {
+	digest := sha256.Sum256([]byte(salt + ":" + consumerID))
+	return hex.EncodeToString(digest[:])
+}
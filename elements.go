@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Element types, each indexed under its own key by indexElements.
+const ELEMENT_PALLET = "pallet"
+const ELEMENT_CASE = "case"
+const ELEMENT_UNIT = "unit"
+
+// ElementLocation records where a pallet, case or unit currently sits.
+type ElementLocation struct {
+	ElementType string `json:"element_type"`
+	ElementId   string `json:"element_id"`
+	ParentId    string `json:"parent_id"`
+	ContainerId string `json:"container_id"`
+}
+
+// UnitDetails is a unit together with its ancestry and the provenance of the
+// container holding it. The supply chain of Provenance is the unit's own
+// history, running through the containers of its lineage.
+type UnitDetails struct {
+	Unit             Unit                `json:"unit"`
+	CaseId           string              `json:"case_id"`
+	PalletId         string              `json:"pallet_id"`
+	ContainerId      string              `json:"container_id"`
+	ContainerLineage []string            `json:"container_lineage"`
+	Custodian        string              `json:"custodian"`
+	Provenance       ContainerProvenance `json:"provenance"`
+}
+
+// indexElements writes an ElementLocation for every pallet, case and unit in
+// the container, replacing any earlier location.
+func indexElements(stub shim.ChaincodeStubInterface, container Container) error {
+	for _, pallet := range container.Elements.Pallets {
+		err := putElementLocation(stub, ElementLocation{ELEMENT_PALLET, pallet.PalletId, container.ContainerId, container.ContainerId})
+		if err != nil {
+			return err
+		}
+		for _, palletCase := range pallet.Cases {
+			err = putElementLocation(stub, ElementLocation{ELEMENT_CASE, palletCase.CaseId, pallet.PalletId, container.ContainerId})
+			if err != nil {
+				return err
+			}
+			for _, unit := range palletCase.Units {
+				err = putElementLocation(stub, ElementLocation{ELEMENT_UNIT, unit.UnitId, palletCase.CaseId, container.ContainerId})
+				if err != nil {
+					return err
+				}
+				if err = indexBatch(stub, unit); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// previousContainer returns the container palletID was in before container:
+// the merge source recorded for the pallet, else the container it was split
+// or rejected from. Only the first limit activities of container belong to
+// the pallet's history. It also returns the index of the activity of
+// container that brought the pallet over and the number of activities of the
+// previous container before the pallet left it. It returns nil at the root.
+func previousContainer(stub shim.ChaincodeStubInterface, container Container, palletID string, limit int) (*Container, int, int, error) {
+	supplychain := container.Provenance.Supplychain[:limit]
+	previousID, arrivedAt := "", 0
+	for index := len(supplychain) - 1; index >= 0 && previousID == ""; index-- {
+		if supplychain[index].Status != STATUS_MERGED || supplychain[index].Aggregation == nil {
+			continue
+		}
+		for _, move := range supplychain[index].Aggregation.Moves {
+			if move.ElementId == palletID {
+				previousID, arrivedAt = move.FromContainerId, index
+			}
+		}
+	}
+	if previousID == "" && container.ParentContainerId != "" {
+		previousID, arrivedAt = container.ParentContainerId, -1
+		for index := len(supplychain) - 1; index >= 0; index-- {
+			if supplychain[index].Status != STATUS_MERGED && containsString(supplychain[index].RelatedContainers, previousID) {
+				arrivedAt = index
+				break
+			}
+		}
+	}
+	if previousID == "" {
+		return nil, 0, 0, nil
+	}
+	previous, err := getContainer(stub, previousID)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if arrivedAt < 0 {
+		// no activity records the hand-over, so the history stays as it is
+		return &previous, 0, 0, nil
+	}
+	previousLimit := 0
+	for index := len(previous.Provenance.Supplychain) - 1; index >= 0; index-- {
+		if containsString(previous.Provenance.Supplychain[index].RelatedContainers, container.ContainerId) {
+			previousLimit = index
+			break
+		}
+	}
+	return &previous, arrivedAt, previousLimit, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func putElementLocation(stub shim.ChaincodeStubInterface, location ElementLocation) error {
+	jsonVal, _ := json.Marshal(location)
+	err := stub.PutState(createCompositeKey(location.ElementType, []string{location.ElementId}), jsonVal)
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for "+location.ElementType+" "+location.ElementId)
+	}
+	return nil
+}
+
+func getElementLocation(stub shim.ChaincodeStubInterface, elementType string, elementID string) (ElementLocation, error) {
+	location := ElementLocation{}
+	valAsbytes, err := stub.GetState(createCompositeKey(elementType, []string{elementID}))
+	if err != nil {
+		return location, newError(ERR_STATE, "Failed to get state for "+elementType+" "+elementID)
+	}
+	if len(valAsbytes) == 0 {
+		return location, newError(ERR_NOT_FOUND, "No "+elementType+" "+elementID+" has been shipped")
+	}
+	json.Unmarshal(valAsbytes, &location)
+	return location, nil
+}
+
+// getContainer loads a container, failing if it does not exist.
+func getContainer(stub shim.ChaincodeStubInterface, containerID string) (Container, error) {
+	container := Container{}
+	valAsbytes, err := stub.GetState(containerID)
+	if err != nil {
+		return container, newError(ERR_STATE, "Failed to get state for container "+containerID)
+	}
+	if len(valAsbytes) == 0 {
+		return container, newError(ERR_NOT_FOUND, "Container "+containerID+" does not exist")
+	}
+	json.Unmarshal(valAsbytes, &container)
+	return container, nil
+}
+
+func putContainer(stub shim.ChaincodeStubInterface, container Container) error {
+	jsonVal, _ := json.Marshal(container)
+	err := stub.PutState(container.ContainerId, jsonVal)
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for container "+container.ContainerId)
+	}
+	return nil
+}
+
+// findUnit returns the pallet and case indexes of unitID within the container,
+// or -1, -1 and nil when it is not there.
+func findUnit(container Container, unitID string) (int, int, *Unit) {
+	for palletIndex := range container.Elements.Pallets {
+		cases := container.Elements.Pallets[palletIndex].Cases
+		for caseIndex := range cases {
+			for unitIndex := range cases[caseIndex].Units {
+				if cases[caseIndex].Units[unitIndex].UnitId == unitID {
+					return palletIndex, caseIndex, &cases[caseIndex].Units[unitIndex]
+				}
+			}
+		}
+	}
+	return -1, -1, nil
+}
+
+// GetUnitDetails looks a unit up by its own ID and returns it with its case,
+// pallet, container lineage and provenance.
+func (t *PharmaChaincode) GetUnitDetails(stub shim.ChaincodeStubInterface, unitID string) ([]byte, error) {
+	location, err := getElementLocation(stub, ELEMENT_UNIT, unitID)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getContainer(stub, location.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+	palletIndex, _, unit := findUnit(container, unitID)
+	if unit == nil {
+		return nil, newError(ERR_STATE, "Unit "+unitID+" is indexed in container "+container.ContainerId+" but not found there")
+	}
+	details := UnitDetails{
+		Unit:        *unit,
+		CaseId:      location.ParentId,
+		PalletId:    container.Elements.Pallets[palletIndex].PalletId,
+		ContainerId: container.ContainerId,
+		Custodian:   container.Custodian,
+		Provenance:  container.Provenance}
+	details.ContainerLineage = append(details.ContainerLineage, container.ContainerId)
+	visited := map[string]bool{container.ContainerId: true}
+	history := container.Provenance.Supplychain
+	limit := len(history)
+	for {
+		previous, arrivedAt, previousLimit, err := previousContainer(stub, container, details.PalletId, limit)
+		if err != nil {
+			return nil, err
+		}
+		if previous == nil {
+			break
+		}
+		if visited[previous.ContainerId] {
+			return nil, newError(ERR_STATE, "Container lineage of unit "+unitID+" loops back to "+previous.ContainerId)
+		}
+		visited[previous.ContainerId] = true
+		details.ContainerLineage = append(details.ContainerLineage, previous.ContainerId)
+		// the first previousLimit activities of the previous container lead up
+		// to the one at arrivedAt that brought the pallet over
+		history = append(append([]ChainActivity(nil), previous.Provenance.Supplychain[:previousLimit]...), history[arrivedAt:]...)
+		container, limit = *previous, previousLimit
+	}
+	details.Provenance.Supplychain = history
+	jsonVal, _ := json.Marshal(details)
+	return jsonVal, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// EXPIRY_CONFIG holds the ExpiryConfig.
+const EXPIRY_CONFIG = "ExpiryConfig"
+
+// expiryInputLayouts are the formats accepted for an expiry date. Dates are
+// always written back in EXPIRY_DATE_LAYOUT.
+var expiryInputLayouts = []string{EXPIRY_DATE_LAYOUT, time.RFC3339, "20060102"}
+
+// Date is a calendar date serialized as YYYY-MM-DD. Text that cannot be parsed
+// as a date, for instance on containers shipped before dates were validated,
+// leaves the Date zero but is kept and written back unchanged.
+type Date struct {
+	time.Time
+	raw string
+}
+
+func (d Date) String() string {
+	if d.IsZero() {
+		return d.raw
+	}
+	return d.Format(EXPIRY_DATE_LAYOUT)
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	*d = Date{raw: text}
+	for _, layout := range expiryInputLayouts {
+		parsed, err := time.Parse(layout, strings.TrimSpace(text))
+		if err == nil {
+			y, m, day := parsed.Date()
+			d.Time = time.Date(y, m, day, 0, 0, 0, 0, time.UTC)
+			return nil
+		}
+	}
+	return nil
+}
+
+// ExpiryConfig is the chaincode-wide expiry policy.
+type ExpiryConfig struct {
+	// WindowDays refuses shipments of units expiring within this many days.
+	WindowDays int `json:"window_days"`
+}
+
+// ExpiringUnit is a unit reported by GetExpiringUnits.
+type ExpiringUnit struct {
+	UnitId      string `json:"unit_id"`
+	DrugId      string `json:"drug_id"`
+	DrugName    string `json:"drug_name"`
+	BatchNumber string `json:"batch_number"`
+	ExpiryDate  Date   `json:"expiry_date"`
+	ContainerId string `json:"container_id"`
+}
+
+// SetExpiryWindow sets how many days before expiry units stop being shipped or
+// dispatched.
+func (t *PharmaChaincode) SetExpiryWindow(stub shim.ChaincodeStubInterface, days string) ([]byte, error) {
+	windowDays, err := strconv.Atoi(days)
+	if err != nil || windowDays < 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "days", "Expecting a non-negative number of days")
+	}
+	jsonVal, _ := json.Marshal(ExpiryConfig{WindowDays: windowDays})
+	err = stub.PutState(EXPIRY_CONFIG, jsonVal)
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to put state for "+EXPIRY_CONFIG)
+	}
+	return nil, nil
+}
+
+// GetExpiringUnits lists the units in containers held by the custodian that
+// have expired or expire within the given number of days.
+func (t *PharmaChaincode) GetExpiringUnits(stub shim.ChaincodeStubInterface, custodianID string, days string) ([]byte, error) {
+	windowDays, err := strconv.Atoi(days)
+	if err != nil || windowDays < 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "days", "Expecting a non-negative number of days")
+	}
+	cutoff, err := expiryCutoff(stub, windowDays)
+	if err != nil {
+		return nil, err
+	}
+	containerList, err := getContainersForCustodian(stub, custodianID)
+	if err != nil {
+		return nil, err
+	}
+	expiring := []ExpiringUnit{}
+	for _, containerID := range containerList {
+		container, err := getContainer(stub, containerID)
+		if err != nil {
+			return nil, err
+		}
+		for _, unit := range expiringUnits(container, cutoff) {
+			expiring = append(expiring, ExpiringUnit{
+				UnitId:      unit.UnitId,
+				DrugId:      unit.DrugId,
+				DrugName:    unit.DrugName,
+				BatchNumber: unit.BatchNumber,
+				ExpiryDate:  unit.ExpiryDate,
+				ContainerId: containerID})
+		}
+	}
+	jsonVal, _ := json.Marshal(expiring)
+	return jsonVal, nil
+}
+
+// checkExpiry refuses to move a container holding units that have expired or
+// will expire within the configured window.
+func checkExpiry(stub shim.ChaincodeStubInterface, container Container) error {
+	config, err := getExpiryConfig(stub)
+	if err != nil {
+		return err
+	}
+	cutoff, err := expiryCutoff(stub, config.WindowDays)
+	if err != nil {
+		return err
+	}
+	var violations []string
+	for _, unit := range expiringUnits(container, cutoff) {
+		violations = append(violations, "unit "+unit.UnitId+" expires "+unit.ExpiryDate.String())
+	}
+	if len(violations) > 0 {
+		expiryErr := newError(ERR_EXPIRED, "Container "+container.ContainerId+" holds units expired or expiring within "+strconv.Itoa(config.WindowDays)+" days")
+		expiryErr.Violations = violations
+		return expiryErr
+	}
+	return nil
+}
+
+// expiryCutoff is the first day on which units are still usable after
+// windowDays, counted from the transaction date.
+func expiryCutoff(stub shim.ChaincodeStubInterface, windowDays int) (time.Time, error) {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return time.Time{}, err
+	}
+	y, m, d := txTime.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).AddDate(0, 0, windowDays), nil
+}
+
+// expiringUnits returns the units of the container whose expiry date is before
+// cutoff. Retired units and units without a parseable date are skipped.
+func expiringUnits(container Container, cutoff time.Time) []Unit {
+	var units []Unit
+	for _, pallet := range container.Elements.Pallets {
+		for _, palletCase := range pallet.Cases {
+			for _, unit := range palletCase.Units {
+				if !unitRetired(unit) && !unit.ExpiryDate.IsZero() && unit.ExpiryDate.Before(cutoff) {
+					units = append(units, unit)
+				}
+			}
+		}
+	}
+	return units
+}
+
+func getExpiryConfig(stub shim.ChaincodeStubInterface) (ExpiryConfig, error) {
+	config := ExpiryConfig{}
+	valAsbytes, err := stub.GetState(EXPIRY_CONFIG)
+	if err != nil {
+		return config, newError(ERR_STATE, "Failed to get state for "+EXPIRY_CONFIG)
+	}
+	if len(valAsbytes) > 0 {
+		json.Unmarshal(valAsbytes, &config)
+	}
+	return config, nil
+}
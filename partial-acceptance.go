@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ItemRejection is one pallet or case refused on receipt, with its reason code
+// and free-text remarks.
+type ItemRejection struct {
+	ElementType string `json:"element_type"`
+	ElementId   string `json:"element_id"`
+	ReasonCode  string `json:"reason_code"`
+	Remarks     string `json:"remarks,omitempty"`
+}
+
+// PartiallyAcceptContainerbyDistributor accepts a dispatched container except
+// for the pallets and cases listed in rejectionsJSON, e.g.
+// [{"element_id":"CON1PAL2","reason_code":"damaged","remarks":"crushed"}].
+// The rejected items move to a new child container, rejected and left with the
+// carrier, which goes back to its sender through InitiateReturn. Rejected
+// cases are gathered on a new pallet of the child, and cases and pallets left
+// empty are dropped from the accepted container. Returns the child container
+// ID.
+func (t *PharmaChaincode) PartiallyAcceptContainerbyDistributor(stub shim.ChaincodeStubInterface, containerID string, receiverID string, rejectionsJSON string) ([]byte, error) {
+	fmt.Println("running PartiallyAcceptContainerbyDistributor:" + containerID)
+	var rejections []ItemRejection
+	err := json.Unmarshal([]byte(rejectionsJSON), &rejections)
+	if err != nil || len(rejections) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "rejections_json", "Expecting a non-empty list of rejected pallets or cases")
+	}
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkNamedReceiver(container, receiverID); err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, receiverID); err != nil {
+		return nil, err
+	}
+	if container.Provenance.TransitStatus != STATUS_DISPATCHED {
+		return nil, newError(ERR_INVALID_TRANSITION, "Container "+containerID+" can only be partially accepted once dispatched, not while "+container.Provenance.TransitStatus)
+	}
+
+	palletOfCase := make(map[string]string)
+	for _, pallet := range container.Elements.Pallets {
+		for _, palletCase := range pallet.Cases {
+			palletOfCase[palletCase.CaseId] = pallet.PalletId
+		}
+	}
+	rejected := make(map[string]bool)
+	var violations []string
+	for index, rejection := range rejections {
+		if err := checkReasonCode("rejections_json", rejection.ReasonCode); err != nil {
+			violations = append(violations, rejection.ElementId+": "+err.(*ChaincodeError).Message)
+		}
+		if findPallet(&container, rejection.ElementId) != nil {
+			rejections[index].ElementType = ELEMENT_PALLET
+		} else if _, ok := palletOfCase[rejection.ElementId]; ok {
+			rejections[index].ElementType = ELEMENT_CASE
+		} else {
+			violations = append(violations, rejection.ElementId+" is not a pallet or case of container "+containerID)
+		}
+		if rejected[rejection.ElementId] {
+			violations = append(violations, rejection.ElementId+" is listed more than once")
+		}
+		rejected[rejection.ElementId] = true
+	}
+	for _, rejection := range rejections {
+		if rejection.ElementType == ELEMENT_CASE && rejected[palletOfCase[rejection.ElementId]] {
+			violations = append(violations, "case "+rejection.ElementId+" is on rejected pallet "+palletOfCase[rejection.ElementId])
+		}
+	}
+	if len(violations) > 0 {
+		rejectionErr := newFieldError(ERR_INVALID_ARGUMENT, "rejections_json", "Rejections failed validation")
+		rejectionErr.Violations = violations
+		return nil, rejectionErr
+	}
+
+	childID, err := allocateContainerID(stub)
+	if err != nil {
+		return nil, err
+	}
+	child := Container{
+		ContainerId:       childID,
+		ParentContainerId: containerID,
+		CertifiedBy:       container.CertifiedBy,
+		Recipient:         receiverID,
+		Provenance:        container.Provenance}
+	child.Provenance.Supplychain = append([]ChainActivity(nil), container.Provenance.Supplychain...)
+	child.Excursions = append([]Excursion(nil), container.Excursions...)
+	loosePallet := Pallet{PalletId: childID + "PAL1"}
+	for _, rejection := range rejections {
+		if rejection.ElementType == ELEMENT_CASE {
+			palletCase, err := takeCase(&container, palletOfCase[rejection.ElementId], rejection.ElementId)
+			if err != nil {
+				return nil, err
+			}
+			loosePallet.Cases = append(loosePallet.Cases, palletCase)
+		}
+	}
+	var remaining []Pallet
+	for _, pallet := range container.Elements.Pallets {
+		if rejected[pallet.PalletId] {
+			child.Elements.Pallets = append(child.Elements.Pallets, pallet)
+			continue
+		}
+		var cases []Case
+		for _, palletCase := range pallet.Cases {
+			if len(palletCase.Units) > 0 {
+				cases = append(cases, palletCase)
+			}
+		}
+		if len(cases) > 0 {
+			pallet.Cases = cases
+			remaining = append(remaining, pallet)
+		}
+	}
+	container.Elements.Pallets = remaining
+	if len(remaining) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "rejections_json", "Every case of container "+containerID+" is rejected; use RejectContainerbyDistributor")
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(loosePallet.Cases) > 0 {
+		use, _, err := serialInUse(stub, ELEMENT_PALLET, loosePallet.PalletId)
+		if err != nil {
+			return nil, err
+		}
+		if use != "" {
+			return nil, newError(ERR_DUPLICATE_SERIAL, "Cannot gather the rejected cases on a new pallet: "+use)
+		}
+		child.Elements.Pallets = append(child.Elements.Pallets, loosePallet)
+		err = putSerial(stub, Serial{
+			SerialNumber: loosePallet.PalletId,
+			ElementType:  ELEMENT_PALLET,
+			Status:       SERIAL_ACTIVE,
+			ContainerId:  childID,
+			RegisteredBy: receiverID,
+			RegisteredAt: txTime,
+			TxID:         stub.GetTxID()})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rejectActivity, err := newChainActivity(stub, container.Provenance.Sender, receiverID, STATUS_REJECTED)
+	if err != nil {
+		return nil, err
+	}
+	rejectActivity.RelatedContainers = []string{containerID}
+	rejectActivity.Rejections = rejections
+	child.Provenance.Supplychain = append(child.Provenance.Supplychain, rejectActivity)
+	child.Provenance.TransitStatus = STATUS_REJECTED
+	child.Provenance.Receiver = receiverID
+	if err = transferCustody(stub, &child, container.Custodian); err != nil {
+		return nil, err
+	}
+	if err = setCurrentOwner(stub, container.Custodian, childID); err != nil {
+		return nil, err
+	}
+	if err = setCurrentOwner(stub, receiverID, childID); err != nil {
+		return nil, err
+	}
+	if err = putContainer(stub, child); err != nil {
+		return nil, err
+	}
+	if err = indexElements(stub, child); err != nil {
+		return nil, err
+	}
+
+	acceptActivity, err := newChainActivity(stub, container.Provenance.Sender, receiverID, STATUS_ACCEPTED)
+	if err != nil {
+		return nil, err
+	}
+	acceptActivity.RelatedContainers = []string{childID}
+	acceptActivity.Rejections = rejections
+	container.Provenance.Supplychain = append(container.Provenance.Supplychain, acceptActivity)
+	container.Provenance.TransitStatus = STATUS_ACCEPTED
+	container.Provenance.Receiver = receiverID
+	container.Recipient = receiverID
+	container.ChildContainerId = append(container.ChildContainerId, childID)
+	if err = transferCustody(stub, &container, receiverID); err != nil {
+		return nil, err
+	}
+	if err = setCurrentOwner(stub, receiverID, containerID); err != nil {
+		return nil, err
+	}
+	if err = putContainer(stub, container); err != nil {
+		return nil, err
+	}
+	for _, rejection := range rejections {
+		err = recordRejection(stub, Rejection{
+			ReasonCode:  rejection.ReasonCode,
+			Remarks:     rejection.Remarks,
+			ElementType: rejection.ElementType,
+			ElementId:   rejection.ElementId,
+			ContainerId: containerID,
+			Sender:      container.Provenance.Sender,
+			RejectedBy:  receiverID})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte(childID), nil
+}
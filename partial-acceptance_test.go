@@ -0,0 +1,143 @@
+package main
+
+import "testing"
+
+func TestPartiallyAcceptContainer(t *testing.T) {
+	rejection := func(elementID string, reasonCode string) string {
+		return `{"element_id":"` + elementID + `","reason_code":"` + reasonCode + `"}`
+	}
+	tests := []struct {
+		name             string
+		undispatched     bool
+		receiver         string
+		rejections       func(pallets []Pallet) string
+		wantCode         string
+		wantParentUnits  int
+		wantChildPallets int
+	}{
+		{
+			name:     "pallet rejected",
+			receiver: "DIST",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[1].PalletId, REASON_DAMAGED) + "]"
+			},
+			wantParentUnits:  4,
+			wantChildPallets: 1},
+		{
+			name:     "case rejected",
+			receiver: "DIST",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[0].Cases[1].CaseId, REASON_QUANTITY_MISMATCH) + "]"
+			},
+			wantParentUnits:  6,
+			wantChildPallets: 1},
+		{
+			name:     "every case of a pallet rejected",
+			receiver: "DIST",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[0].Cases[0].CaseId, REASON_DAMAGED) + "," + rejection(pallets[0].Cases[1].CaseId, REASON_DAMAGED) + "]"
+			},
+			wantParentUnits:  4,
+			wantChildPallets: 1},
+		{
+			name:     "pallet and case rejected",
+			receiver: "DIST",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[1].PalletId, REASON_DAMAGED) + "," + rejection(pallets[0].Cases[0].CaseId, REASON_DAMAGED) + "]"
+			},
+			wantParentUnits:  2,
+			wantChildPallets: 2},
+		{
+			name:     "everything rejected",
+			receiver: "DIST",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[0].PalletId, REASON_DAMAGED) + "," + rejection(pallets[1].PalletId, REASON_DAMAGED) + "]"
+			},
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "case on a rejected pallet",
+			receiver: "DIST",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[0].PalletId, REASON_DAMAGED) + "," + rejection(pallets[0].Cases[0].CaseId, REASON_DAMAGED) + "]"
+			},
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "unknown element",
+			receiver: "DIST",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection("CON9PAL1", REASON_DAMAGED) + "]"
+			},
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "unknown reason",
+			receiver: "DIST",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[0].PalletId, "lost") + "]"
+			},
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name:     "not the receiver",
+			receiver: "PH",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[0].PalletId, REASON_DAMAGED) + "]"
+			},
+			wantCode: ERR_FORBIDDEN},
+		{
+			name:         "not dispatched",
+			undispatched: true,
+			receiver:     "LOG",
+			rejections: func(pallets []Pallet) string {
+				return "[" + rejection(pallets[0].PalletId, REASON_DAMAGED) + "]"
+			},
+			wantCode: ERR_INVALID_TRANSITION},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			containerID := shipTestContainer(t, stub, "B1")
+			steps := []step{{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""}}
+			if !test.undispatched {
+				steps = append(steps, step{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""})
+			}
+			runSteps(t, stub, steps)
+			pallets := stub.getContainer(t, containerID).Elements.Pallets
+			childID, err := stub.caller(ROLE_DISTRIBUTOR, test.receiver).invoke("PartiallyAcceptContainerbyDistributor", containerID, test.receiver, test.rejections(pallets))
+			if code := errorCode(err); code != test.wantCode {
+				t.Fatalf("got %q (%v), want %q", code, err, test.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			parent := stub.getContainer(t, containerID)
+			if parent.Provenance.TransitStatus != STATUS_ACCEPTED || parent.Custodian != "DIST" {
+				t.Fatalf("parent is %s with %s, want accepted by DIST", parent.Provenance.TransitStatus, parent.Custodian)
+			}
+			if len(unitIDsOf(parent)) != test.wantParentUnits {
+				t.Fatalf("parent holds %d units, want %d", len(unitIDsOf(parent)), test.wantParentUnits)
+			}
+			for _, pallet := range parent.Elements.Pallets {
+				for _, palletCase := range pallet.Cases {
+					if len(palletCase.Units) == 0 {
+						t.Fatalf("parent keeps empty case %s", palletCase.CaseId)
+					}
+				}
+			}
+			child := stub.getContainer(t, string(childID))
+			if child.Provenance.TransitStatus != STATUS_REJECTED || child.Custodian != "LOG" || child.ParentContainerId != containerID {
+				t.Fatalf("child is %s with %s from %s, want rejected with LOG from %s", child.Provenance.TransitStatus, child.Custodian, child.ParentContainerId, containerID)
+			}
+			if len(child.Elements.Pallets) != test.wantChildPallets {
+				t.Fatalf("child holds %d pallets, want %d", len(child.Elements.Pallets), test.wantChildPallets)
+			}
+			if len(unitIDsOf(parent))+len(unitIDsOf(child)) != 8 {
+				t.Fatalf("units lost: %d accepted, %d rejected", len(unitIDsOf(parent)), len(unitIDsOf(child)))
+			}
+			for _, unitID := range unitIDsOf(child) {
+				location, err := getElementLocation(stub, ELEMENT_UNIT, unitID)
+				if err != nil || location.ContainerId != child.ContainerId {
+					t.Fatalf("unit %s located at %+v %v", unitID, location, err)
+				}
+			}
+		})
+	}
+}
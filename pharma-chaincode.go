@@ -2,10 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
   
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
@@ -14,8 +15,41 @@ const STATUS_SHIPPED = "shipped"
 const STATUS_ACCEPTED = "accepted"
 const STATUS_REJECTED = "rejected"
 const STATUS_DISPATCHED = "dispatched"
+const STATUS_SPLIT = "split"
+const STATUS_MERGED = "merged"
+const STATUS_RETURN_INITIATED = "return_initiated"
+const STATUS_RETURN_SHIPPED = "return_shipped"
+const STATUS_RETURNED = "returned"
+const STATUS_QUARANTINED = "quarantined"
+const STATUS_DESTROYED = "destroyed"
+// STATUS_RESTOCKED marks a returned container put back into stock. It is never
+// a transit status; a restocked container is accepted again.
+const STATUS_RESTOCKED = "restocked"
+// STATUS_AGGREGATED marks repack activities. It is never a transit status.
+const STATUS_AGGREGATED = "aggregated"
 const UNIQUE_ID_COUNTER string = "UniqueIDCounter"
 const CONTAINER_OWNER = "ContainerOwner"
+const OWNER_CONTAINER_INDEX = "owner~container"
+const CUSTODIAN_CONTAINER_INDEX = "custodian~container"
+const COMPOSITE_KEY_SEPARATOR = "\x00"
+
+// containerTransitions is the container lifecycle: for every transit status it
+// lists the statuses a container may move to next. Statuses without an entry,
+// such as STATUS_DESTROYED, are terminal. An accepted container may be shipped
+// on again as a new leg, split into child containers, merged into another or
+// destroyed; once its units expire it may also go back to its sender.
+// A rejected container goes back to its sender, unless it never left, and is
+// then restocked, quarantined or destroyed.
+var containerTransitions = map[string][]string{
+	STATUS_SHIPPED:          {STATUS_ACCEPTED, STATUS_REJECTED},
+	STATUS_ACCEPTED:         {STATUS_DISPATCHED, STATUS_SHIPPED, STATUS_SPLIT, STATUS_MERGED, STATUS_DESTROYED, STATUS_RETURN_INITIATED},
+	STATUS_DISPATCHED:       {STATUS_ACCEPTED, STATUS_REJECTED},
+	STATUS_REJECTED:         {STATUS_RETURN_INITIATED, STATUS_RESTOCKED, STATUS_QUARANTINED, STATUS_DESTROYED},
+	STATUS_RETURN_INITIATED: {STATUS_RETURN_SHIPPED},
+	STATUS_RETURN_SHIPPED:   {STATUS_RETURNED},
+	STATUS_RETURNED:         {STATUS_RESTOCKED, STATUS_QUARANTINED, STATUS_DESTROYED},
+	STATUS_QUARANTINED:      {STATUS_RESTOCKED, STATUS_DESTROYED},
+}
 
 type PharmaChaincode struct {
 }
@@ -34,6 +68,7 @@ type Container struct {
 	ContainerId       string              `json:"container_id"`
 	ParentContainerId string              `json:"parent_container_id"`
 	ChildContainerId  []string            `json:"child_container_id"`
+	MergedFromContainerId []string        `json:"merged_from_container_id"`
 	Recipient         string              `json:"recipient_id"`
 	Elements          ContainerElements   `json:"elements"`
 	Provenance        ContainerProvenance `json:"provenance"`
@@ -43,6 +78,9 @@ type Container struct {
 	ShipmentDate      string              `json:"shipment_date"`  
 	InvoiceNumber     string              `json:"invoice_number"` 
 	Remarks           string              `json:"remarks"`        
+	Custodian         string              `json:"custodian"`
+	ReturnTo          string              `json:"return_to,omitempty"`
+	Excursions        []Excursion         `json:"excursions,omitempty"`
   
 }
 
@@ -64,12 +102,18 @@ type Unit struct {
 	DrugId       string `json:"drug_id"`
 	DrugName     string `json:"drug_name"` 
 	UnitId       string `json:"unit_id"`
-	ExpiryDate   string `json:"expiry_date"`
+	ExpiryDate   Date   `json:"expiry_date"`
 	HealthStatus string `json:"health_status"`
 	BatchNumber  string `json:"batch_number"`
 	LotNumber    string `json:"lot_number"`
 	SaleStatus   string `json:"sale_status"`
-	ConsumerName string `json:"consumer_name"`
+	// consumers are recorded only as a commitment, never by name
+	ConsumerCommitment string `json:"consumer_commitment,omitempty"`
+	RecallId     string `json:"recall_id"`
+	DispensedBy  string     `json:"dispensed_by,omitempty"`
+	DispensedAt  *time.Time `json:"dispensed_at,omitempty"`
+	DispenseTxID string     `json:"dispense_tx_id,omitempty"`
+	DestructionTxID string  `json:"destruction_tx_id,omitempty"`
 }
 
 type ContainerProvenance struct {
@@ -84,9 +128,16 @@ type ChainActivity struct {
 	Receiver string `json:receiver`
 	Status   string `json:transit_status`
 	ActivityTimeStamp time.Time `json:activity_timeStamp`
-	//ActivityTimeStamp1 time.Time `json:activity_timeStamp`
+	TxID              string    `json:"tx_id"`
+	ReasonCode        string    `json:"reason_code,omitempty"`
+	Remarks           string    `json:"remarks,omitempty"`
+	Rejections        []ItemRejection `json:"rejections,omitempty"`
+	RelatedContainers []string  `json:"related_containers,omitempty"`
+	Aggregation       *AggregationEvent `json:"aggregation,omitempty"`
 }
 
+// ContainerOwners is the legacy single-document owner record once stored under
+// CONTAINER_OWNER. It is still the response shape of GetOwner.
 type ContainerOwners struct {
 	Owners []Owner `json:owners`
 }
@@ -112,54 +163,19 @@ func (t *PharmaChaincode) Init(stub shim.ChaincodeStubInterface, function string
 	}
 	fmt.Println("invoke did not find func: " + function)
 
-	return nil, errors.New("Received unknown function invocation: " + function)
+	return nil, &ChaincodeError{Code: ERR_UNKNOWN_FUNCTION, Message: "Received unknown function invocation: " + function, Function: function}
 }
 
 // Invoke isur entry point to invoke a chaincode function
 func (t *PharmaChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
-
-	// Handle different functions
-	if function == "ShipContainerUsingLogistics" {
-		return t.ShipContainerUsingLogistics(stub, args[0], args[1], args[2], args[3], args[4])
-	} else if function == "SetCurrentOwner"{
-		return t.SetCurrentOwnerTest(stub, args[0], args[1])
-	} else if function == "AcceptContainerbyLogistics"{
-		return t.AcceptContainerbyLogistics(stub, args[0], args[1],args[2], args[3])
-	}else if function == "DispatchContainer"{
-		return t.DispatchContainer(stub, args[0], args[1],args[2])
-	}else if function == "AcceptContainerbyDistributor"{
-		return t.AcceptContainerbyDistributor(stub, args[0], args[1],args[2]) 
-	}else if function == "RejectContainerbyLogistics"{
-		return t.RejectContainerbyLogistics(stub, args[0], args[1],args[2],args[3]) 
-	}else if function == "RejectContainerbyDistributor"{
-		return t.RejectContainerbyDistributor(stub, args[0], args[1],args[2]) 
-	}	 
-	fmt.Println("invoke did not find func: " + function)
-	return nil, errors.New("Received unknown function invocation: " + function)
+	return t.dispatch(stub, invokeFunctions, function, args)
 }
 
 // Query is our entry point for queries
 func (t *PharmaChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("query is running " + function)
-
-	// Handle different functions
-	if function == "GetContainerDetails" { //read a variable
-		return t.GetContainerDetails(stub, args[0])
-	} else if function == "GetMaxIDValue" {
-		return t.GetMaxIDValue(stub)
-	} else if function == "GetEmptyContainer" {
-		return t.GetEmptyContainer(stub)
-	}  else if function == "GetContainerDetailsForOwner" {
-		return t.GetContainerDetailsForOwner(stub, args[0])
-	}else if function == "GetOwner" {
-		return t.GetOwner(stub)
-	}else if function == "GetUserAttribute" {
-		return t.GetUserAttribute(stub, args[0])
-	}
-	
-	fmt.Println("query did not find func: " + function)
-	return nil, errors.New("Received unknown function query: " + function)
+	return t.dispatch(stub, queryFunctions, function, args)
 }
 
 func (t *PharmaChaincode) init(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
@@ -175,24 +191,101 @@ func (t *PharmaChaincode) init(stub shim.ChaincodeStubInterface, args []string)
 	return nil, nil
 }
 
-// write  invoke function to write key/value pair
+// write  invoke function to write key/value pair. Shipping an existing
+// container is only allowed from a status that permits re-shipment, by its
+// current custodian; the new leg is appended to the existing provenance.
 func (t *PharmaChaincode) ShipContainerUsingLogistics(stub shim.ChaincodeStubInterface,
 	senderID string, logisticsID string, receiverID string, remarks string, elementsJSON string) ([]byte, error) {
 	var err error
+	if err = checkCaller(stub, senderID); err != nil {
+		return nil, err
+	}
 
-	containerID, jsonValue := ShipContainerUsingLogistics_Internal(senderID, logisticsID, receiverID, remarks, elementsJSON)
+	shipment, err := parseContainer(elementsJSON)
+	if err != nil {
+		return nil, err
+	}
+	containerID := shipment.ContainerId
 	fmt.Println("running ShipContainerUsingLogistics.key:" + containerID)
-	fmt.Println(jsonValue)
-	err = stub.PutState(containerID, jsonValue) //write the variable into the chaincode state
-
-	incrementCounter(stub) //increment the unique ids for container and Pallet
+	valAsbytes, err := stub.GetState(containerID)
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to get state for container "+containerID)
+	}
+	reshipment := len(valAsbytes) > 0
+	var newBatches []string
+	if reshipment {
+		existing := Container{}
+		json.Unmarshal(valAsbytes, &existing)
+		if err = checkTransition(existing, STATUS_SHIPPED); err != nil {
+			return nil, err
+		}
+		if existing.Custodian != senderID {
+			return nil, newError(ERR_FORBIDDEN, "Container "+containerID+" is held by "+existing.Custodian+", not "+senderID)
+		}
+		// the contents travel unchanged, only the shipment details are new
+		shipment.Elements = existing.Elements
+		shipment.ParentContainerId = existing.ParentContainerId
+		shipment.ChildContainerId = existing.ChildContainerId
+		shipment.MergedFromContainerId = existing.MergedFromContainerId
+		shipment.Provenance = existing.Provenance
+		shipment.Custodian = existing.Custodian
+		shipment.Excursions = existing.Excursions
+	} else {
+		if err = checkNewContainer(shipment); err != nil {
+			return nil, err
+		}
+		if err = checkSerials(stub, shipment); err != nil {
+			return nil, err
+		}
+		if newBatches, err = checkBatchOwners(stub, shipment, senderID); err != nil {
+			return nil, err
+		}
+	}
 
-	setCurrentOwner(stub, senderID, containerID)
-	setCurrentOwner(stub, logisticsID, containerID)
+	if err = checkExpiry(stub, shipment); err != nil {
+		return nil, err
+	}
+	if !reshipment {
+		if err = useReservation(stub, shipment, senderID); err != nil {
+			return nil, err
+		}
+	}
 
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	// the sender keeps custody until logistics accepts the container
+	shipment.Custodian = senderID
+	jsonValue := ShipContainerUsingLogistics_Internal(shipment, senderID, logisticsID, receiverID, txTime, stub.GetTxID())
+	fmt.Println(jsonValue)
+	err = stub.PutState(containerID, jsonValue) //write the variable into the chaincode state
 	if err != nil {
 		return nil, err
 	}
+	err = indexElements(stub, shipment)
+	if err != nil {
+		return nil, err
+	}
+	if !reshipment {
+		if err = registerSerials(stub, shipment, senderID, txTime); err != nil {
+			return nil, err
+		}
+		if err = registerBatchOwners(stub, newBatches, senderID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = setCurrentOwner(stub, senderID, containerID); err != nil {
+		return nil, err
+	}
+	if err = setCurrentOwner(stub, logisticsID, containerID); err != nil {
+		return nil, err
+	}
+	if err = setCustodian(stub, senderID, containerID); err != nil {
+		return nil, err
+	}
+
 	return nil, nil
 
 }
@@ -201,44 +294,53 @@ func (t *PharmaChaincode)DispatchContainer(stub shim.ChaincodeStubInterface,cont
 	fmt.Println("running DispatchContainer:" + containerID)
      valAsbytes, err := stub.GetState(containerID)
 	 if len(valAsbytes) == 0 {
-		 	jsonResp := "{\"Error\":\"Failed to get state for Container id since there is no such container \"}"
-		return nil, errors.New(jsonResp)
+			return nil, newError(ERR_NOT_FOUND, "Container "+containerID+" does not exist")
 	 }
 	 fmt.Println("json value from the container")
 	 fmt.Println(valAsbytes)
 	 if err != nil{
-		jsonResp := "{\"Error\":\"Failed to get state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to get state for container "+containerID)
 	}
 	 shipment := Container{}	  
 	json.Unmarshal([]byte(valAsbytes), &shipment)
+	if err := checkCaller(stub, shipment.Custodian); err != nil {
+		return nil, err
+	}
+	if err := checkTransition(shipment, STATUS_DISPATCHED); err != nil {
+		return nil, err
+	}
+	if err := checkExpiry(stub, shipment); err != nil {
+		return nil, err
+	}
 	shipment.Recipient = receiverID
 	conprov := shipment.Provenance  
     supplychain := conprov.Supplychain     
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
 	chainActivity := ChainActivity{
-		Sender:   shipment.Provenance.Receiver,//
+		Sender:   shipment.Custodian,
 		Receiver: receiverID,
 		Status:   STATUS_DISPATCHED,
-		ActivityTimeStamp:time.Now().UTC()}  
+		ActivityTimeStamp: txTime,
+		TxID:              stub.GetTxID()}  
 	supplychain = append(supplychain, chainActivity) 
 	conprov.Supplychain = supplychain
    conprov.TransitStatus = STATUS_DISPATCHED
-   conprov.Sender = shipment.Provenance.Receiver
+   conprov.Sender = shipment.Custodian
    conprov.Receiver = receiverID
    shipment.Provenance = conprov
+	// logistics keeps custody in transit until the receiver accepts it
     jsonVal, _ := json.Marshal(shipment)
    	err = stub.PutState(containerID, jsonVal)//write the variable into the chaincode state
     if err != nil{
-		jsonResp := "{\"Error\":\"Failed to put state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to put state for container "+containerID)
 	}
 	fmt.Println("********DISPATCHED JSON***********")	
-	fmt.Println("SENDER",shipment.Provenance.Receiver)	
+	fmt.Println("SENDER",shipment.Provenance.Sender)	
 	fmt.Println(string(jsonVal))	
-	incrementCounter(stub) //increment the unique ids for container and Pallet
-	setCurrentOwner(stub, receiverID, containerID)
-
-	if err != nil {
+	if err = setCurrentOwner(stub, receiverID, containerID); err != nil {
 		return nil, err
 	}
 	return nil, nil
@@ -250,19 +352,17 @@ func (t *PharmaChaincode)DispatchContainer(stub shim.ChaincodeStubInterface,cont
 // read  query function to read key/value pair
 func (t *PharmaChaincode) GetContainerDetails(stub shim.ChaincodeStubInterface, container_id string) ([]byte, error) {
 	fmt.Println("runnin GetContainerDetails ")
-	var key, jsonResp string
 	var err error
 
 	if container_id == "" {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the key to query")
+		return nil, newFieldError(ERR_MISSING_ARGUMENT, "container_id", "Expecting name of the key to query")
 	}
 
 	fmt.Println("key:" + container_id)
 	valAsbytes, err := stub.GetState(container_id)
 	fmt.Println(valAsbytes)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to get state for "+container_id)
 	}
 
 	return valAsbytes, nil
@@ -270,104 +370,207 @@ func (t *PharmaChaincode) GetContainerDetails(stub shim.ChaincodeStubInterface,
 
 //Returns the maximum number used for ContainerID and PalletID in the format "ContainerMaxNumber, PalletMaxNumber"
 func (t *PharmaChaincode) GetMaxIDValue(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	var jsonResp string
 	var err error
 	ConMaxAsbytes, err := stub.GetState(UNIQUE_ID_COUNTER)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for ContainerMaxNumber \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to get state for ContainerMaxNumber")
 	}
 	return ConMaxAsbytes, nil
 }
 
-func (t *PharmaChaincode) GetEmptyContainer(stub shim.ChaincodeStubInterface) ([]byte, error) {
+// GetEmptyContainer previews the container ReserveContainer would hand out
+// next for the named packaging template. The IDs are not held for the caller
+// and cannot be shipped until they have been reserved.
+func (t *PharmaChaincode) GetEmptyContainer(stub shim.ChaincodeStubInterface, templateName string) ([]byte, error) {
+	template, err := getPackagingTemplate(stub, templateName)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getEmptyContainer(stub, template)
+	if err != nil {
+		return nil, err
+	}
+	jsonVal, _ := json.Marshal(container)
+	return jsonVal, nil
+}
+
+// getEmptyContainer lays out a container to the template using the next
+// unused container and pallet IDs.
+func getEmptyContainer(stub shim.ChaincodeStubInterface, template PackagingTemplate) (Container, error) {
 	ConMaxAsbytes, err := stub.GetState(UNIQUE_ID_COUNTER)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for ContainerMaxNumber \"}"
-		return nil, errors.New(jsonResp)
+		return Container{}, newError(ERR_STATE, "Failed to get state for ContainerMaxNumber")
 	}
 
 	counter := UniqueIDCounter{}
 	json.Unmarshal([]byte(ConMaxAsbytes), &counter)
 	containerID := "CON" + strconv.Itoa(counter.ContainerMaxID+1)
-	pallets := createPallet(containerID, counter.PalletMaxID+1)
+	pallets := createPallet(containerID, counter.PalletMaxID+1, template)
 	conelement := ContainerElements{Pallets: pallets}
 	container := Container{
 		ContainerId: containerID,
 		Elements:    conelement}
-	jsonVal, _ := json.Marshal(container)
-	return jsonVal, nil
+	return container, nil
 }
 
-func ShipContainerUsingLogistics_Internal(senderID string,
-	logisticsID string, receiverID string, remarks string, elementsJSON string) (string, []byte) {
-		//ActivityTimeStamp1=time.Now().UTC()
+// ShipContainerUsingLogistics_Internal appends a shipped leg from senderID to
+// logisticsID to the container's provenance and returns it serialized.
+func ShipContainerUsingLogistics_Internal(shipment Container, senderID string,
+	logisticsID string, receiverID string, txTime time.Time, txID string) []byte {
 	chainActivity := ChainActivity{
-		Sender:   senderID,
-		Receiver: logisticsID,
-		Status:   STATUS_SHIPPED,
-		ActivityTimeStamp:time.Now().UTC()}
-		//ActivityTimeStamp: ActivityTimeStamp1.Format("20060102 15:04:05")} 
-	var supplyChain []ChainActivity
-	supplyChain = append(supplyChain, chainActivity)
-	conprov := ContainerProvenance{
-		TransitStatus: STATUS_SHIPPED,
-		Sender:        senderID,
-		Receiver:      logisticsID,
-		Supplychain:   supplyChain}
-	shipment := Container{}
-	json.Unmarshal([]byte(elementsJSON), &shipment)
+		Sender:            senderID,
+		Receiver:          logisticsID,
+		Status:            STATUS_SHIPPED,
+		ActivityTimeStamp: txTime,
+		TxID:              txID}
+	conprov := shipment.Provenance
+	conprov.Supplychain = append(conprov.Supplychain, chainActivity)
+	conprov.TransitStatus = STATUS_SHIPPED
+	conprov.Sender = senderID
+	conprov.Receiver = logisticsID
 	shipment.Recipient = receiverID
 	shipment.Provenance = conprov
 	jsonVal, _ := json.Marshal(shipment)
-	return shipment.ContainerId, jsonVal
+	return jsonVal
 }
 
-func createUnit(caseID string) []Unit {
-	units := make([]Unit, 3)
+// parseContainer unmarshals the elements JSON submitted with a shipment. The
+// contents are only validated for new containers, see checkNewContainer.
+func parseContainer(elementsJSON string) (Container, error) {
+	shipment := Container{}
+	err := json.Unmarshal([]byte(elementsJSON), &shipment)
+	if err != nil {
+		return shipment, newFieldError(ERR_INVALID_ARGUMENT, "elements_json", "Failed to parse elements JSON: "+err.Error())
+	}
+	if shipment.ContainerId == "" {
+		return shipment, newFieldError(ERR_INVALID_ARGUMENT, "elements_json", "container_id is required")
+	}
+	// lineage, provenance, custody and unit lifecycle are maintained by the
+	// chaincode, never the caller
+	shipment.ParentContainerId = ""
+	shipment.ChildContainerId = nil
+	shipment.MergedFromContainerId = nil
+	shipment.Provenance = ContainerProvenance{}
+	shipment.Custodian = ""
+	shipment.ReturnTo = ""
+	shipment.Excursions = nil
+	for palletIndex := range shipment.Elements.Pallets {
+		cases := shipment.Elements.Pallets[palletIndex].Cases
+		for caseIndex := range cases {
+			for unitIndex := range cases[caseIndex].Units {
+				unit := &cases[caseIndex].Units[unitIndex]
+				unit.RecallId = ""
+				unit.SaleStatus = ""
+				unit.ConsumerCommitment = ""
+				unit.DispensedBy = ""
+				unit.DispensedAt = nil
+				unit.DispenseTxID = ""
+				unit.DestructionTxID = ""
+			}
+		}
+	}
+	return shipment, nil
+}
+
+func createUnit(caseID string, template PackagingTemplate) []Unit {
+	units := make([]Unit, template.UnitsPerCase)
 
-	for index := 0; index < 3; index++ {
+	for index := 0; index < template.UnitsPerCase; index++ {
 		strIndex := strconv.Itoa(index + 1)
 		unitid := caseID + "UNIT" + strIndex
 		units[index].UnitId = unitid
+		units[index].DrugId = template.DrugId
+		units[index].DrugName = template.DrugName
 	}
 	return units
 }
 
-func createCase(palletID string) []Case {
-	cases := make([]Case, 3)
+func createCase(palletID string, template PackagingTemplate) []Case {
+	cases := make([]Case, template.CasesPerPallet)
 
-	for index := 0; index < 3; index++ {
+	for index := 0; index < template.CasesPerPallet; index++ {
 		strIndex := strconv.Itoa(index + 1)
 		caseid := palletID + "CASE" + strIndex
 		cases[index].CaseId = caseid
-		cases[index].Units = createUnit(caseid)
+		cases[index].Units = createUnit(caseid, template)
 	}
 	return cases
 }
 
-func createPallet(containerID string, palletMaxID int) []Pallet {
-	pallets := make([]Pallet, 3)
-	for index := 0; index < 3; index++ {
+func createPallet(containerID string, palletMaxID int, template PackagingTemplate) []Pallet {
+	pallets := make([]Pallet, template.PalletCount)
+	for index := 0; index < template.PalletCount; index++ {
 		strMaxID := strconv.Itoa(palletMaxID)
 		palletid := containerID + "PAL" + strMaxID
 		pallets[index].PalletId = palletid
-		pallets[index].Cases = createCase(palletid)
+		pallets[index].Cases = createCase(palletid, template)
 		palletMaxID++
 	}
 	return pallets
 }
 
-func incrementCounter(stub shim.ChaincodeStubInterface) error {
+// checkTransition returns an error unless containerTransitions allows the
+// container to move from its current transit status to next.
+func checkTransition(container Container, next string) error {
+	current := container.Provenance.TransitStatus
+	for _, allowed := range containerTransitions[current] {
+		if allowed == next {
+			return nil
+		}
+	}
+	return newError(ERR_INVALID_TRANSITION, "Container "+container.ContainerId+" cannot move from status "+current+" to "+next)
+}
+
+// getTxTime returns the timestamp of the transaction being executed. Unlike
+// time.Now it is identical on every endorsing peer.
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, newError(ERR_INTERNAL, "Failed to get the transaction timestamp")
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
+
+// newChainActivity builds an activity stamped with the current transaction.
+func newChainActivity(stub shim.ChaincodeStubInterface, sender string, receiver string, status string) (ChainActivity, error) {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return ChainActivity{}, err
+	}
+	chainActivity := ChainActivity{
+		Sender:            sender,
+		Receiver:          receiver,
+		Status:            status,
+		ActivityTimeStamp: txTime,
+		TxID:              stub.GetTxID()}
+	return chainActivity, nil
+}
+
+// allocateContainerID consumes and returns the next container ID.
+func allocateContainerID(stub shim.ChaincodeStubInterface) (string, error) {
+	ConMaxAsbytes, err := stub.GetState(UNIQUE_ID_COUNTER)
+	if err != nil {
+		return "", newError(ERR_STATE, "Failed to get state for ContainerMaxNumber")
+	}
+	counter := UniqueIDCounter{}
+	json.Unmarshal([]byte(ConMaxAsbytes), &counter)
+	err = incrementCounter(stub, 0)
+	if err != nil {
+		return "", err
+	}
+	return "CON" + strconv.Itoa(counter.ContainerMaxID+1), nil
+}
+
+// incrementCounter consumes one container ID and palletCount pallet IDs.
+func incrementCounter(stub shim.ChaincodeStubInterface, palletCount int) error {
 	ConMaxAsbytes, err := stub.GetState(UNIQUE_ID_COUNTER)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for ContainerMaxNumber \"}"
-		return errors.New(jsonResp)
+		return newError(ERR_STATE, "Failed to get state for ContainerMaxNumber")
 	}
 	counter := UniqueIDCounter{}
 	json.Unmarshal([]byte(ConMaxAsbytes), &counter)
 	counter.ContainerMaxID = counter.ContainerMaxID + 1
-	counter.PalletMaxID = counter.PalletMaxID + 3
+	counter.PalletMaxID = counter.PalletMaxID + palletCount
 	jsonVal, _ := json.Marshal(counter)
 	err = stub.PutState(UNIQUE_ID_COUNTER, []byte(jsonVal))
 	if err != nil {
@@ -381,55 +584,172 @@ func (t *PharmaChaincode) SetCurrentOwnerTest(stub shim.ChaincodeStubInterface,
 	return []byte("success"), err
 }
 
+// GetContainerDetailsForOwner returns every container the owner has ever
+// handled, including the ones it has since handed off.
 func (t *PharmaChaincode) GetContainerDetailsForOwner(stub shim.ChaincodeStubInterface, ownerID string) ([]byte, error) {
 
 	fmt.Println("Fetching container details for Owner:" + ownerID)
 
-	ConMaxAsbytes, err := stub.GetState(CONTAINER_OWNER)
+	containerList, err := getContainersForOwner(stub, ownerID)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for Container Owners \"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	ConOwners := ContainerOwners{}
-	json.Unmarshal([]byte(ConMaxAsbytes), &ConOwners)
+	if len(containerList) > 0 {
+		fmt.Println("MatchFound for Owner:" + ownerID)
+		return t.getShipment(stub, containerList)
+	} else {
+		fmt.Println("Container details not found for Owner:" + ownerID)
+		return nil, newError(ERR_NOT_FOUND, "Unable to get container details for Owner:"+ownerID)
+	}
+}
 
-	var containerList []string
-	var matchFound bool
+// GetContainerDetailsForCustodian returns only the containers the custodian
+// currently holds.
+func (t *PharmaChaincode) GetContainerDetailsForCustodian(stub shim.ChaincodeStubInterface, custodianID string) ([]byte, error) {
+	fmt.Println("Fetching container details for Custodian:" + custodianID)
 
-	for index := range ConOwners.Owners {
-		if ConOwners.Owners[index].OwnerId == ownerID {
-			containerList = ConOwners.Owners[index].ContainerList
-			matchFound = true
-			break
+	containerList, err := getContainersForCustodian(stub, custodianID)
+	if err != nil {
+		return nil, err
+	}
+	return t.getShipment(stub, containerList)
+}
+
+// getShipment loads the listed containers into a single Shipment document.
+func (t *PharmaChaincode) getShipment(stub shim.ChaincodeStubInterface, containerList []string) ([]byte, error) {
+	shipment := Shipment{}
+	for _, containerID := range containerList {
+		byteVal, _ := t.GetContainerDetails(stub, containerID)
+		container := Container{}
+
+		json.Unmarshal([]byte(byteVal), &container)
+		shipment.ContainerList = append(shipment.ContainerList, container)
+	}
+	jsonVal, _ := json.Marshal(shipment)
+	return jsonVal, nil
+}
+
+// GetOwner lists every owner together with the containers recorded against it
+// in the owner~container index.
+func (t *PharmaChaincode) GetOwner(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("************Am in GET OWNER Method**********")
+	keys, err := rangeCompositeKeys(stub, OWNER_CONTAINER_INDEX, nil)
+	if err != nil {
+		return nil, err
+	}
+	ConOwners := ContainerOwners{}
+	for _, key := range keys {
+		_, attributes := splitCompositeKey(key)
+		ownerID, containerID := attributes[0], attributes[1]
+		last := len(ConOwners.Owners) - 1
+		// keys come back sorted, so all the containers of an owner are adjacent
+		if last < 0 || ConOwners.Owners[last].OwnerId != ownerID {
+			ConOwners.Owners = append(ConOwners.Owners, Owner{OwnerId: ownerID})
+			last++
 		}
+		ConOwners.Owners[last].ContainerList = append(ConOwners.Owners[last].ContainerList, containerID)
 	}
-	if matchFound {
-		fmt.Println("MatchFound for Owner:" + ownerID)
-		shipment := Shipment{}
-	
-		for _, containerID := range containerList {
-			byteVal, _ := t.GetContainerDetails(stub, containerID)
-			container := Container{}
+	jsonVal, _ := json.Marshal(ConOwners)
+	return jsonVal, nil
+}
 
-			json.Unmarshal([]byte(byteVal), &container)
-			shipment.ContainerList = append(shipment.ContainerList, container)
+// MigrateContainerOwners brings containers stored by earlier versions of the
+// chaincode up to date. It explodes the legacy CONTAINER_OWNER document into
+// owner~container keys and deletes it, then gives every owned container that
+// has never had a custodian the party that last accepted it, or else its
+// sender, and indexes its elements and serials. Running it again is a no-op.
+// It returns the number of containers it assigned a custodian.
+func (t *PharmaChaincode) MigrateContainerOwners(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("running MigrateContainerOwners")
+	ConOwnersAsbytes, err := stub.GetState(CONTAINER_OWNER)
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to get state for Container Owners")
+	}
+	if len(ConOwnersAsbytes) > 0 {
+		ConOwners := ContainerOwners{}
+		err = json.Unmarshal(ConOwnersAsbytes, &ConOwners)
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to parse Container Owners")
 		}
-		jsonVal, _ := json.Marshal(shipment)
-		return jsonVal, nil
-	} else {
-		fmt.Println("Container details not found for Owner:" + ownerID)
-		return nil, errors.New("Unable to get container details for Owner:" + ownerID)
+		for _, owner := range ConOwners.Owners {
+			for _, containerID := range owner.ContainerList {
+				err = setCurrentOwner(stub, owner.OwnerId, containerID)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		err = stub.DelState(CONTAINER_OWNER)
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to delete state for Container Owners")
+		}
+	}
+	keys, err := rangeCompositeKeys(stub, OWNER_CONTAINER_INDEX, nil)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	migrated := 0
+	for _, key := range keys {
+		_, attributes := splitCompositeKey(key)
+		containerID := attributes[1]
+		if seen[containerID] {
+			continue
+		}
+		seen[containerID] = true
+		container, err := getContainer(stub, containerID)
+		if err != nil {
+			return nil, err
+		}
+		// emptied and destroyed containers have given up custody for good
+		switch {
+		case container.Custodian != "":
+			continue
+		case container.Provenance.TransitStatus == STATUS_SPLIT,
+			container.Provenance.TransitStatus == STATUS_MERGED,
+			container.Provenance.TransitStatus == STATUS_DESTROYED:
+			continue
+		}
+		if err = migrateContainer(stub, &container); err != nil {
+			return nil, err
+		}
+		migrated++
 	}
+	return []byte(strconv.Itoa(migrated)), nil
 }
-func (t *PharmaChaincode) GetOwner(stub shim.ChaincodeStubInterface) ([]byte, error) {
 
-	ConMaxAsbytes, err := stub.GetState(CONTAINER_OWNER)
-	fmt.Println("************Am in GET OWNER Method**********")
+// migrateContainer sets the custodian of a container stored before custody
+// was tracked and writes the element, batch and serial indexes it predates.
+func migrateContainer(stub shim.ChaincodeStubInterface, container *Container) error {
+	custodianID, registeredBy := returnOrigin(*container), ""
+	registeredAt, err := getTxTime(stub)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for Container Owners \"}"
-		return nil, errors.New(jsonResp)
+		return err
 	}
-	return ConMaxAsbytes, nil
+	for _, activity := range container.Provenance.Supplychain {
+		if activity.Status == STATUS_ACCEPTED {
+			custodianID = activity.Receiver
+		}
+	}
+	for _, activity := range container.Provenance.Supplychain {
+		if activity.Status == STATUS_SHIPPED {
+			registeredBy, registeredAt = activity.Sender, activity.ActivityTimeStamp
+			break
+		}
+	}
+	if custodianID == "" {
+		return newError(ERR_STATE, "Container "+container.ContainerId+" has no shipment to take its custodian from")
+	}
+	if err = transferCustody(stub, container, custodianID); err != nil {
+		return err
+	}
+	if err = putContainer(stub, *container); err != nil {
+		return err
+	}
+	if err = indexElements(stub, *container); err != nil {
+		return err
+	}
+	return backfillSerials(stub, *container, registeredBy, registeredAt)
 }
 func (t *PharmaChaincode) AcceptContainerbyLogistics(stub shim.ChaincodeStubInterface,containerID string, logisticsID string, receiverID string, remarks string) ([]byte, error) {
 
@@ -437,73 +757,102 @@ func (t *PharmaChaincode) AcceptContainerbyLogistics(stub shim.ChaincodeStubInte
 	fmt.Println("Accepting the  container by Logistics:" + containerID)
      valAsbytes, err := stub.GetState(containerID)
 	 if len(valAsbytes) == 0 {
-		 	jsonResp := "{\"Error\":\"Failed to get state for Container id since there is no such container \"}"
-		return nil, errors.New(jsonResp)
+			return nil, newError(ERR_NOT_FOUND, "Container "+containerID+" does not exist")
 	 }
 	 fmt.Println("json value from the container****************")
 	 fmt.Println(valAsbytes)
 	 if err != nil{
-		jsonResp := "{\"Error\":\"Failed to get state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to get state for container "+containerID)
 	}
 	//timeLayOut := timePresent.Format(RFC1123)
 	  shipment := Container{}	  
 	json.Unmarshal([]byte(valAsbytes), &shipment)
+	if err := checkNamedReceiver(shipment, logisticsID); err != nil {
+		return nil, err
+	}
+	if err := checkCaller(stub, logisticsID); err != nil {
+		return nil, err
+	}
+	if err := checkTransition(shipment, STATUS_ACCEPTED); err != nil {
+		return nil, err
+	}
 	shipment.Recipient = receiverID
 	conprov := shipment.Provenance  
     supplychain := conprov.Supplychain     
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
 	chainActivity := ChainActivity{
 		Sender:   shipment.Provenance.Sender,
 		Receiver: logisticsID,
 		Status:   STATUS_ACCEPTED,
-		ActivityTimeStamp:time.Now().UTC()}  
+		ActivityTimeStamp: txTime,
+		TxID:              stub.GetTxID()}  
 	supplychain = append(supplychain, chainActivity) 
 	conprov.Supplychain = supplychain
    conprov.TransitStatus = STATUS_ACCEPTED
    conprov.Sender = shipment.Provenance.Sender
    conprov.Receiver = logisticsID
    shipment.Provenance = conprov
+	if err := transferCustody(stub, &shipment, logisticsID); err != nil {
+		return nil, err
+	}
    jsonVal, _ := json.Marshal(shipment)
    	err = stub.PutState(containerID, jsonVal)
     if err != nil{
-		jsonResp := "{\"Error\":\"Failed to put state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to put state for container "+containerID)
 	}	
 	fmt.Println(string(jsonVal))
 	fmt.Println(string(shipment.Provenance.Sender))
-	setCurrentOwner(stub, logisticsID, containerID)
+	if err = setCurrentOwner(stub, logisticsID, containerID); err != nil {
+		return nil, err
+	}
 	return nil, nil		
 }
-func (t *PharmaChaincode) RejectContainerbyLogistics(stub shim.ChaincodeStubInterface,containerID string, logisticsID string, receiverID string, remarks string) ([]byte, error) {
+func (t *PharmaChaincode) RejectContainerbyLogistics(stub shim.ChaincodeStubInterface,containerID string, logisticsID string, receiverID string, remarks string, reasonCode string) ([]byte, error) {
 
 	fmt.Println("Rejecting the  container by Logistics:" + logisticsID + containerID)
      valAsbytes, err := stub.GetState(containerID)
 	 if len(valAsbytes) == 0 {
-		 	jsonResp := "{\"Error\":\"Failed to get state for Container id since there is no such container \"}"
-		return nil, errors.New(jsonResp)
+			return nil, newError(ERR_NOT_FOUND, "Container "+containerID+" does not exist")
 	 }
 	 fmt.Println("json value from the container****************")
 	 fmt.Println(valAsbytes)
 	 if err != nil{
-		jsonResp := "{\"Error\":\"Failed to get state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to get state for container "+containerID)
+	}
+	fmt.Println(reasonCode, remarks)
+	if err := checkReasonCode("reason_code", reasonCode); err != nil {
+		return nil, err
 	}
-	fmt.Println(remarks)
-	if len(remarks) == 0 {
-		 	jsonResp := "{\"Error\":\"Failed to have the remarks  for Container id since there is no input remarks \"}"
-		return nil, errors.New(jsonResp)
-	 }
 	 shipment := Container{}	  
 	json.Unmarshal([]byte(valAsbytes), &shipment)
+	if err := checkNamedReceiver(shipment, logisticsID); err != nil {
+		return nil, err
+	}
+	if err := checkCaller(stub, logisticsID); err != nil {
+		return nil, err
+	}
+	if err := checkTransition(shipment, STATUS_REJECTED); err != nil {
+		return nil, err
+	}
 	shipment.Recipient = receiverID
 	
 	conprov := shipment.Provenance  
     supplychain := conprov.Supplychain     
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
 	chainActivity := ChainActivity{
 		Sender:   shipment.Provenance.Sender,
 		Receiver: logisticsID,
 		Status:   STATUS_REJECTED,
-		ActivityTimeStamp:time.Now().UTC()}  
+		ActivityTimeStamp: txTime,
+		TxID:              stub.GetTxID(),
+		ReasonCode:        reasonCode,
+		Remarks:           remarks}  
 	supplychain = append(supplychain, chainActivity) 
 	conprov.Supplychain = supplychain
    conprov.TransitStatus = STATUS_REJECTED
@@ -513,12 +862,24 @@ func (t *PharmaChaincode) RejectContainerbyLogistics(stub shim.ChaincodeStubInte
    jsonVal, _ := json.Marshal(shipment)
    	err = stub.PutState(containerID, jsonVal)
     if err != nil{
-		jsonResp := "{\"Error\":\"Failed to put state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to put state for container "+containerID)
 	}	
 	fmt.Println(string(jsonVal))
 	fmt.Println("SENDER",shipment.Provenance.Sender)
-		setCurrentOwner(stub, logisticsID, containerID)
+	if err = setCurrentOwner(stub, logisticsID, containerID); err != nil {
+		return nil, err
+	}
+	err = recordRejection(stub, Rejection{
+		ReasonCode:  reasonCode,
+		Remarks:     remarks,
+		ElementType: ELEMENT_CONTAINER,
+		ElementId:   containerID,
+		ContainerId: containerID,
+		Sender:      shipment.Provenance.Sender,
+		RejectedBy:  logisticsID})
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil		
 }
 
@@ -527,25 +888,37 @@ func (t *PharmaChaincode) AcceptContainerbyDistributor(stub shim.ChaincodeStubIn
 	fmt.Println("Accepting the  container by Logistics:" + containerID)
      valAsbytes, err := stub.GetState(containerID)
 	 if len(valAsbytes) == 0 {
-		 	jsonResp := "{\"Error\":\"Failed to get state for Container id since there is no such container \"}"
-		return nil, errors.New(jsonResp)
+			return nil, newError(ERR_NOT_FOUND, "Container "+containerID+" does not exist")
 	 }
 	 fmt.Println("json value from the container****************")
 	 fmt.Println(valAsbytes)
 	 if err != nil{
-		jsonResp := "{\"Error\":\"Failed to get state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to get state for container "+containerID)
 	}
 	  shipment := Container{}	  
 	json.Unmarshal([]byte(valAsbytes), &shipment)
+	if err := checkNamedReceiver(shipment, receiverID); err != nil {
+		return nil, err
+	}
+	if err := checkCaller(stub, receiverID); err != nil {
+		return nil, err
+	}
+	if err := checkTransition(shipment, STATUS_ACCEPTED); err != nil {
+		return nil, err
+	}
 	shipment.Recipient = receiverID
 	conprov := shipment.Provenance  
     supplychain := conprov.Supplychain     
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
 	chainActivity := ChainActivity{
 		Sender:   shipment.Provenance.Sender,
 		Receiver: receiverID,
 		Status:   STATUS_ACCEPTED,
-		ActivityTimeStamp:time.Now().UTC()}  
+		ActivityTimeStamp: txTime,
+		TxID:              stub.GetTxID()}  
 	supplychain = append(supplychain, chainActivity) 
 	conprov.Supplychain = supplychain
    conprov.TransitStatus = STATUS_ACCEPTED
@@ -553,48 +926,64 @@ func (t *PharmaChaincode) AcceptContainerbyDistributor(stub shim.ChaincodeStubIn
    conprov.Sender = shipment.Provenance.Sender
    conprov.Receiver = receiverID
    shipment.Provenance = conprov
+	if err := transferCustody(stub, &shipment, receiverID); err != nil {
+		return nil, err
+	}
    jsonVal, _ := json.Marshal(shipment)
    	err = stub.PutState(containerID, jsonVal)
     if err != nil{
-		jsonResp := "{\"Error\":\"Failed to put state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to put state for container "+containerID)
 	}
 	fmt.Println("JSON ACCEPTED BY Reciever")	
 		fmt.Println(string(jsonVal))
-	setCurrentOwner(stub, receiverID, containerID)
+	if err = setCurrentOwner(stub, receiverID, containerID); err != nil {
+		return nil, err
+	}
 	return nil, nil		
 }
 
-func (t *PharmaChaincode) RejectContainerbyDistributor(stub shim.ChaincodeStubInterface,containerID string, receiverID string, remarks string) ([]byte, error) {
+func (t *PharmaChaincode) RejectContainerbyDistributor(stub shim.ChaincodeStubInterface,containerID string, receiverID string, remarks string, reasonCode string) ([]byte, error) {
     fmt.Println("Running RejectContainerbyDistributor ")
 	fmt.Println("Accepting the  container by Logistics:" + containerID)
      valAsbytes, err := stub.GetState(containerID)
 	 if len(valAsbytes) == 0 {
-		 	jsonResp := "{\"Error\":\"Failed to get state for Container id since there is no such container \"}"
-		return nil, errors.New(jsonResp)
+			return nil, newError(ERR_NOT_FOUND, "Container "+containerID+" does not exist")
 	 }
 	 fmt.Println("json value from the container****************")
 	 fmt.Println(valAsbytes)
 	 if err != nil{
-		jsonResp := "{\"Error\":\"Failed to get state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to get state for container "+containerID)
+	}
+	 fmt.Println(reasonCode, remarks)
+	if err := checkReasonCode("reason_code", reasonCode); err != nil {
+		return nil, err
 	}
-	 fmt.Println(remarks)
-	if len(remarks) == 0 {
-		 	jsonResp := "{\"Error\":\"Failed to have the remarks  for Container id since there is no input remarks \"}"
-		return nil, errors.New(jsonResp)
-	 }
 	  shipment := Container{}
 	json.Unmarshal([]byte(valAsbytes), &shipment)
+	if err := checkNamedReceiver(shipment, receiverID); err != nil {
+		return nil, err
+	}
+	if err := checkCaller(stub, receiverID); err != nil {
+		return nil, err
+	}
+	if err := checkTransition(shipment, STATUS_REJECTED); err != nil {
+		return nil, err
+	}
 	shipment.Recipient = receiverID
 	conprov := shipment.Provenance  
     supplychain := conprov.Supplychain     
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
 	chainActivity := ChainActivity{
 		Sender:   shipment.Provenance.Sender,
 		Receiver: receiverID,
 		Status:   STATUS_REJECTED,		 
-		// ActivityTimeStamp=timeLayOut}
-		ActivityTimeStamp:time.Now().UTC()}  
+		ActivityTimeStamp: txTime,
+		TxID:              stub.GetTxID(),
+		ReasonCode:        reasonCode,
+		Remarks:           remarks}  
 	supplychain = append(supplychain, chainActivity) 
 	conprov.Supplychain = supplychain
    conprov.TransitStatus = STATUS_REJECTED
@@ -605,12 +994,24 @@ func (t *PharmaChaincode) RejectContainerbyDistributor(stub shim.ChaincodeStubIn
    jsonVal, _ := json.Marshal(shipment)
    	err = stub.PutState(containerID, jsonVal)
     if err != nil{
-		jsonResp := "{\"Error\":\"Failed to put state for Container id \"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_STATE, "Failed to put state for container "+containerID)
 	}
 	fmt.Println("JSON ACCEPTED BY Reciever")	
 		fmt.Println(string(jsonVal))
-	setCurrentOwner(stub, receiverID, containerID)
+	if err = setCurrentOwner(stub, receiverID, containerID); err != nil {
+		return nil, err
+	}
+	err = recordRejection(stub, Rejection{
+		ReasonCode:  reasonCode,
+		Remarks:     remarks,
+		ElementType: ELEMENT_CONTAINER,
+		ElementId:   containerID,
+		ContainerId: containerID,
+		Sender:      shipment.Provenance.Sender,
+		RejectedBy:  receiverID})
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil		
 }
 
@@ -620,56 +1021,133 @@ func (t *PharmaChaincode) GetUserAttribute(stub shim.ChaincodeStubInterface, att
 	fmt.Println("attributeValue=" + string(attributeValue))
 	
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get GetUserAttribute\"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(ERR_NOT_FOUND, "Failed to get GetUserAttribute")
 	}
 	return attributeValue, nil
 }
 
+// setCurrentOwner records ownerID as a party to containerID. Each pairing is
+// its own owner~container key so that transactions for different owners never
+// touch the same state.
 func setCurrentOwner(stub shim.ChaincodeStubInterface, ownerID string, containerID string) error {
-	ConMaxAsbytes, err := stub.GetState(CONTAINER_OWNER)
+	key := createCompositeKey(OWNER_CONTAINER_INDEX, []string{ownerID, containerID})
+	err := stub.PutState(key, []byte{0x00})
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for ContainerMaxNumber \"}"
-		return errors.New(jsonResp)
+		return newError(ERR_STATE, "Failed to put state for owner "+ownerID+" of container "+containerID)
 	}
-	ConOwners := ContainerOwners{}
-	json.Unmarshal([]byte(ConMaxAsbytes), &ConOwners)
+	return nil
+}
 
+// getContainersForOwner range-scans the owner~container index for ownerID.
+func getContainersForOwner(stub shim.ChaincodeStubInterface, ownerID string) ([]string, error) {
+	keys, err := rangeCompositeKeys(stub, OWNER_CONTAINER_INDEX, []string{ownerID})
+	if err != nil {
+		return nil, err
+	}
 	var containerList []string
-	var ownerIndex int
-	var matchFound bool
-	for index := range ConOwners.Owners {
-		if ConOwners.Owners[index].OwnerId == ownerID {
-			ownerIndex = index
-			containerList = ConOwners.Owners[index].ContainerList
-			matchFound = true
-			break
-		}
+	for _, key := range keys {
+		_, attributes := splitCompositeKey(key)
+		containerList = append(containerList, attributes[1])
 	}
-	containerFound := false
-	if matchFound {
-		for index := range containerList {
-			if containerList[index] == containerID {
-				containerFound = true
-				break
-			}
-		}
-		if !containerFound {
-			containerList = append(containerList, containerID)
-			ConOwners.Owners[ownerIndex].ContainerList = containerList
-		}
-	} else {
-		containerList := make([]string, 1)
-		containerList[0] = containerID
-		owner := Owner{OwnerId: ownerID, ContainerList: containerList}
-		ConOwners.Owners = append(ConOwners.Owners, owner)
+	return containerList, nil
+}
+
+// setCustodian adds containerID to the custodian~container index of
+// custodianID.
+func setCustodian(stub shim.ChaincodeStubInterface, custodianID string, containerID string) error {
+	key := createCompositeKey(CUSTODIAN_CONTAINER_INDEX, []string{custodianID, containerID})
+	err := stub.PutState(key, []byte{0x00})
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for custodian "+custodianID+" of container "+containerID)
 	}
+	return nil
+}
 
-	jsonVal, _ := json.Marshal(ConOwners)
-	err = stub.PutState(CONTAINER_OWNER, []byte(jsonVal))
+// transferCustody hands container over to custodianID, removing it from the
+// previous custodian's index. The caller still has to write the container.
+func transferCustody(stub shim.ChaincodeStubInterface, container *Container, custodianID string) error {
+	if container.Custodian == custodianID {
+		return nil
+	}
+	if container.Custodian != "" {
+		key := createCompositeKey(CUSTODIAN_CONTAINER_INDEX, []string{container.Custodian, container.ContainerId})
+		err := stub.DelState(key)
+		if err != nil {
+			return newError(ERR_STATE, "Failed to delete state for custodian "+container.Custodian+" of container "+container.ContainerId)
+		}
+	}
+	err := setCustodian(stub, custodianID, container.ContainerId)
 	if err != nil {
 		return err
 	}
+	container.Custodian = custodianID
+	return nil
+}
 
+// releaseCustody removes container from its custodian's index once it no
+// longer holds anything, for instance after all its pallets have moved out.
+func releaseCustody(stub shim.ChaincodeStubInterface, container *Container) error {
+	if container.Custodian == "" {
+		return nil
+	}
+	key := createCompositeKey(CUSTODIAN_CONTAINER_INDEX, []string{container.Custodian, container.ContainerId})
+	err := stub.DelState(key)
+	if err != nil {
+		return newError(ERR_STATE, "Failed to delete state for custodian "+container.Custodian+" of container "+container.ContainerId)
+	}
+	container.Custodian = ""
 	return nil
-}
\ No newline at end of file
+}
+
+// getContainersForCustodian range-scans the custodian~container index for
+// custodianID.
+func getContainersForCustodian(stub shim.ChaincodeStubInterface, custodianID string) ([]string, error) {
+	keys, err := rangeCompositeKeys(stub, CUSTODIAN_CONTAINER_INDEX, []string{custodianID})
+	if err != nil {
+		return nil, err
+	}
+	var containerList []string
+	for _, key := range keys {
+		_, attributes := splitCompositeKey(key)
+		containerList = append(containerList, attributes[1])
+	}
+	return containerList, nil
+}
+
+// createCompositeKey joins objectType and attributes into a single state key.
+// Every component is terminated by COMPOSITE_KEY_SEPARATOR so a partial key is a
+// strict prefix of all the keys extending it.
+func createCompositeKey(objectType string, attributes []string) string {
+	key := COMPOSITE_KEY_SEPARATOR + objectType + COMPOSITE_KEY_SEPARATOR
+	for _, attribute := range attributes {
+		key += attribute + COMPOSITE_KEY_SEPARATOR
+	}
+	return key
+}
+
+// splitCompositeKey is the inverse of createCompositeKey.
+func splitCompositeKey(key string) (string, []string) {
+	components := strings.Split(strings.TrimSuffix(strings.TrimPrefix(key, COMPOSITE_KEY_SEPARATOR), COMPOSITE_KEY_SEPARATOR), COMPOSITE_KEY_SEPARATOR)
+	return components[0], components[1:]
+}
+
+// rangeCompositeKeys returns every key of objectType whose leading attributes
+// match the given partial attributes.
+func rangeCompositeKeys(stub shim.ChaincodeStubInterface, objectType string, attributes []string) ([]string, error) {
+	startKey := createCompositeKey(objectType, attributes)
+	keysIter, err := stub.RangeQueryState(startKey, startKey+string(utf8.MaxRune))
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to range query state for "+objectType)
+	}
+	defer keysIter.Close()
+
+	var keys []string
+	for keysIter.HasNext() {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to read range query result for "+objectType)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import "testing"
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		allowed bool
+	}{
+		{STATUS_SHIPPED, STATUS_ACCEPTED, true},
+		{STATUS_SHIPPED, STATUS_REJECTED, true},
+		{STATUS_SHIPPED, STATUS_DISPATCHED, false},
+		{STATUS_SHIPPED, STATUS_SHIPPED, false},
+		{STATUS_ACCEPTED, STATUS_DISPATCHED, true},
+		{STATUS_ACCEPTED, STATUS_SHIPPED, true},
+		{STATUS_ACCEPTED, STATUS_RETURN_INITIATED, true},
+		{STATUS_ACCEPTED, STATUS_REJECTED, false},
+		{STATUS_DISPATCHED, STATUS_ACCEPTED, true},
+		{STATUS_DISPATCHED, STATUS_DISPATCHED, false},
+		{STATUS_REJECTED, STATUS_RETURN_INITIATED, true},
+		{STATUS_REJECTED, STATUS_SHIPPED, false},
+		{STATUS_RETURN_INITIATED, STATUS_RETURN_SHIPPED, true},
+		{STATUS_RETURN_INITIATED, STATUS_RETURNED, false},
+		{STATUS_RETURNED, STATUS_RESTOCKED, true},
+		{STATUS_QUARANTINED, STATUS_DESTROYED, true},
+		{STATUS_QUARANTINED, STATUS_SHIPPED, false},
+		{STATUS_SPLIT, STATUS_SHIPPED, false},
+		{STATUS_MERGED, STATUS_ACCEPTED, false},
+		{STATUS_DESTROYED, STATUS_RESTOCKED, false},
+	}
+	for _, test := range tests {
+		t.Run(test.from+" to "+test.to, func(t *testing.T) {
+			container := Container{ContainerId: "CON1", Provenance: ContainerProvenance{TransitStatus: test.from}}
+			err := checkTransition(container, test.to)
+			if test.allowed && err != nil {
+				t.Fatalf("refused: %v", err)
+			}
+			if !test.allowed && errorCode(err) != ERR_INVALID_TRANSITION {
+				t.Fatalf("got %v, want %s", err, ERR_INVALID_TRANSITION)
+			}
+		})
+	}
+}
+
+func TestCustody(t *testing.T) {
+	tests := []struct {
+		name          string
+		steps         func(containerID string) []step
+		wantStatus    string
+		wantCustodian string
+	}{
+		{
+			name: "shipped",
+			steps: func(containerID string) []step {
+				return nil
+			},
+			wantStatus:    STATUS_SHIPPED,
+			wantCustodian: "SUP"},
+		{
+			name: "delivered",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""},
+					{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""},
+					{ROLE_DISTRIBUTOR, "DIST", "AcceptContainerbyDistributor", []string{containerID, "DIST", ""}, ""},
+				}
+			},
+			wantStatus:    STATUS_ACCEPTED,
+			wantCustodian: "DIST"},
+		{
+			name: "carrier cannot dispatch before taking custody",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ERR_FORBIDDEN},
+				}
+			},
+			wantStatus:    STATUS_SHIPPED,
+			wantCustodian: "SUP"},
+		{
+			name: "only the named carrier accepts",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG2", "AcceptContainerbyLogistics", []string{containerID, "LOG2", "DIST", ""}, ERR_FORBIDDEN},
+					{ROLE_LOGISTICS, "LOG2", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ERR_FORBIDDEN},
+				}
+			},
+			wantStatus:    STATUS_SHIPPED,
+			wantCustodian: "SUP"},
+		{
+			name: "receiver cannot accept before dispatch",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_DISTRIBUTOR, "DIST", "AcceptContainerbyDistributor", []string{containerID, "DIST", ""}, ERR_FORBIDDEN},
+				}
+			},
+			wantStatus:    STATUS_SHIPPED,
+			wantCustodian: "SUP"},
+		{
+			name: "carrier dispatches once",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""},
+					{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""},
+					{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ERR_INVALID_TRANSITION},
+				}
+			},
+			wantStatus:    STATUS_DISPATCHED,
+			wantCustodian: "LOG"},
+		{
+			name: "rejected by the carrier stays with the sender",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG", "RejectContainerbyLogistics", []string{containerID, "LOG", "DIST", "crushed", REASON_DAMAGED}, ""},
+				}
+			},
+			wantStatus:    STATUS_REJECTED,
+			wantCustodian: "SUP"},
+		{
+			name: "rejected by the receiver stays with the carrier",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""},
+					{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""},
+					{ROLE_DISTRIBUTOR, "DIST", "RejectContainerbyDistributor", []string{containerID, "DIST", "", REASON_DAMAGED}, ERR_MISSING_ARGUMENT},
+					{ROLE_DISTRIBUTOR, "DIST", "RejectContainerbyDistributor", []string{containerID, "DIST", "crushed", "lost"}, ERR_INVALID_ARGUMENT},
+					{ROLE_DISTRIBUTOR, "DIST", "RejectContainerbyDistributor", []string{containerID, "DIST", "crushed", REASON_DAMAGED}, ""},
+				}
+			},
+			wantStatus:    STATUS_REJECTED,
+			wantCustodian: "LOG"},
+		{
+			name: "only the custodian ships on",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""},
+					{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""},
+					{ROLE_DISTRIBUTOR, "DIST", "AcceptContainerbyDistributor", []string{containerID, "DIST", ""}, ""},
+					{ROLE_SUPPLIER, "SUP", "ShipContainerUsingLogistics", []string{"SUP", "LOG", "PH", "", `{"container_id":"` + containerID + `"}`}, ERR_FORBIDDEN},
+					{ROLE_DISTRIBUTOR, "DIST", "ShipContainerUsingLogistics", []string{"DIST", "LOG", "PH", "", `{"container_id":"` + containerID + `"}`}, ""},
+				}
+			},
+			wantStatus:    STATUS_SHIPPED,
+			wantCustodian: "DIST"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			containerID := shipTestContainer(t, stub, "B1")
+			runSteps(t, stub, test.steps(containerID))
+			container := stub.getContainer(t, containerID)
+			if container.Provenance.TransitStatus != test.wantStatus || container.Custodian != test.wantCustodian {
+				t.Fatalf("got %s with %s, want %s with %s", container.Provenance.TransitStatus, container.Custodian, test.wantStatus, test.wantCustodian)
+			}
+			custodianContainers, err := getContainersForCustodian(stub, test.wantCustodian)
+			if err != nil || len(custodianContainers) != 1 || custodianContainers[0] != containerID {
+				t.Fatalf("custodian index of %s: %v %v", test.wantCustodian, custodianContainers, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// RECALL_INDEX keys a Recall by its ID.
+const RECALL_INDEX = "recall"
+
+// BATCH_UNIT_INDEX lists units by batch and lot number so a recall can find
+// them without scanning every container.
+const BATCH_UNIT_INDEX = "batch~lot~unit"
+
+// BATCH_OWNER_INDEX records, once per batch, the supplier that first shipped
+// it. Every lot of the batch belongs to that supplier.
+const BATCH_OWNER_INDEX = "batch~owner"
+
+// Recall is a product recall of every unit of a batch, optionally narrowed to
+// one lot, together with the custodians' quarantine acknowledgements.
+type Recall struct {
+	RecallId         string                  `json:"recall_id"`
+	BatchNumber      string                  `json:"batch_number"`
+	LotNumber        string                  `json:"lot_number"`
+	Reason           string                  `json:"reason"`
+	InitiatedBy      string                  `json:"initiated_by"`
+	InitiatedAt      time.Time               `json:"initiated_at"`
+	TxID             string                  `json:"tx_id"`
+	UnitIds          []string                `json:"unit_ids"`
+	Acknowledgements []RecallAcknowledgement `json:"acknowledgements"`
+}
+
+// RecallAcknowledgement is a custodian confirming that the recalled units in
+// one of its containers are quarantined.
+type RecallAcknowledgement struct {
+	Custodian      string    `json:"custodian"`
+	ContainerId    string    `json:"container_id"`
+	Remarks        string    `json:"remarks"`
+	AcknowledgedAt time.Time `json:"acknowledged_at"`
+	TxID           string    `json:"tx_id"`
+}
+
+// RecallExposure is one container holding recalled units.
+type RecallExposure struct {
+	ContainerId   string   `json:"container_id"`
+	Custodian     string   `json:"custodian"`
+	TransitStatus string   `json:"transit_status"`
+	UnitIds       []string `json:"unit_ids"`
+	Acknowledged  bool     `json:"acknowledged"`
+}
+
+// indexBatch adds a unit to the batch~lot~unit index.
+func indexBatch(stub shim.ChaincodeStubInterface, unit Unit) error {
+	if unit.BatchNumber == "" {
+		return nil
+	}
+	err := stub.PutState(createCompositeKey(BATCH_UNIT_INDEX, []string{unit.BatchNumber, unit.LotNumber, unit.UnitId}), []byte{0x00})
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for batch "+unit.BatchNumber+" of unit "+unit.UnitId)
+	}
+	return nil
+}
+
+// checkBatchOwners refuses a new container holding units of a batch that
+// another supplier shipped first. Only a supplier may ship a batch that has
+// never been shipped. It returns the batches the sender ships for the first
+// time.
+func checkBatchOwners(stub shim.ChaincodeStubInterface, container Container, senderID string) ([]string, error) {
+	role, err := getCallerRole(stub)
+	if err != nil {
+		return nil, err
+	}
+	var newBatches, violations []string
+	seen := make(map[string]bool)
+	for _, pallet := range container.Elements.Pallets {
+		for _, palletCase := range pallet.Cases {
+			for _, unit := range palletCase.Units {
+				if unit.BatchNumber == "" || seen[unit.BatchNumber] {
+					continue
+				}
+				seen[unit.BatchNumber] = true
+				ownerID, err := getBatchOwner(stub, unit.BatchNumber)
+				if err != nil {
+					return nil, err
+				}
+				if ownerID == "" && role != ROLE_SUPPLIER {
+					violations = append(violations, "batch "+unit.BatchNumber+" has not been shipped by its manufacturer")
+				} else if ownerID == "" {
+					newBatches = append(newBatches, unit.BatchNumber)
+				} else if ownerID != senderID {
+					violations = append(violations, "batch "+unit.BatchNumber+" belongs to "+ownerID)
+				}
+			}
+		}
+	}
+	if len(violations) > 0 {
+		batchErr := newFieldError(ERR_FORBIDDEN, "elements_json", "Container "+container.ContainerId+" holds batches of another manufacturer")
+		batchErr.Violations = violations
+		return nil, batchErr
+	}
+	return newBatches, nil
+}
+
+// registerBatchOwners records manufacturerID as the owner of batches shipped
+// for the first time.
+func registerBatchOwners(stub shim.ChaincodeStubInterface, batchNumbers []string, manufacturerID string) error {
+	for _, batchNumber := range batchNumbers {
+		err := stub.PutState(createCompositeKey(BATCH_OWNER_INDEX, []string{batchNumber}), []byte(manufacturerID))
+		if err != nil {
+			return newError(ERR_STATE, "Failed to put state for owner of batch "+batchNumber)
+		}
+	}
+	return nil
+}
+
+// getBatchOwner returns the participant that first shipped the batch, or ""
+// when it has never been shipped.
+func getBatchOwner(stub shim.ChaincodeStubInterface, batchNumber string) (string, error) {
+	valAsbytes, err := stub.GetState(createCompositeKey(BATCH_OWNER_INDEX, []string{batchNumber}))
+	if err != nil {
+		return "", newError(ERR_STATE, "Failed to get state for owner of batch "+batchNumber)
+	}
+	return string(valAsbytes), nil
+}
+
+// InitiateRecall marks every unit of the batch, and of the lot when one is
+// given, as recalled. Units already sold or destroyed are left out; a recall
+// that would reach units already under another recall is refused. A regulator
+// may recall any batch; a supplier only the batches it manufactured.
+func (t *PharmaChaincode) InitiateRecall(stub shim.ChaincodeStubInterface, recallID string, batchNumber string, lotNumber string, reason string) ([]byte, error) {
+	fmt.Println("running InitiateRecall:" + recallID + " for batch " + batchNumber)
+	existing, err := stub.GetState(createCompositeKey(RECALL_INDEX, []string{recallID}))
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to get state for recall "+recallID)
+	}
+	if len(existing) > 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "recall_id", "Recall "+recallID+" already exists")
+	}
+	callerID, err := getCallerID(stub)
+	if err != nil {
+		return nil, err
+	}
+	role, err := getCallerRole(stub)
+	if err != nil {
+		return nil, err
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	recall := Recall{
+		RecallId:    recallID,
+		BatchNumber: batchNumber,
+		LotNumber:   lotNumber,
+		Reason:      reason,
+		InitiatedBy: callerID,
+		InitiatedAt: txTime,
+		TxID:        stub.GetTxID()}
+
+	attributes := []string{batchNumber}
+	if lotNumber != "" {
+		attributes = append(attributes, lotNumber)
+	}
+	keys, err := rangeCompositeKeys(stub, BATCH_UNIT_INDEX, attributes)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "No units found for batch "+batchNumber+" lot "+lotNumber)
+	}
+	if role != ROLE_REGULATOR {
+		manufacturerID, err := getBatchOwner(stub, batchNumber)
+		if err != nil {
+			return nil, err
+		}
+		if manufacturerID != callerID {
+			return nil, newError(ERR_FORBIDDEN, "Batch "+batchNumber+" was not manufactured by "+callerID)
+		}
+	}
+
+	var containerIDs, violations []string
+	containers := make(map[string]*Container)
+	for _, key := range keys {
+		_, keyAttributes := splitCompositeKey(key)
+		unitID := keyAttributes[2]
+		location, err := getElementLocation(stub, ELEMENT_UNIT, unitID)
+		if err != nil {
+			return nil, err
+		}
+		container, ok := containers[location.ContainerId]
+		if !ok {
+			loaded, err := getContainer(stub, location.ContainerId)
+			if err != nil {
+				return nil, err
+			}
+			container = &loaded
+			containers[location.ContainerId] = container
+			containerIDs = append(containerIDs, location.ContainerId)
+		}
+		_, _, unit := findUnit(*container, unitID)
+		if unit == nil {
+			return nil, newError(ERR_STATE, "Unit "+unitID+" is indexed in container "+container.ContainerId+" but not found there")
+		}
+		if unitRetired(*unit) {
+			continue
+		}
+		if unit.RecallId != "" {
+			violations = append(violations, "unit "+unitID+" is already recalled under "+unit.RecallId)
+			continue
+		}
+		unit.RecallId = recallID
+		recall.UnitIds = append(recall.UnitIds, unitID)
+	}
+	if len(violations) > 0 {
+		recallErr := newFieldError(ERR_INVALID_ARGUMENT, "batch_number", "Batch "+batchNumber+" overlaps an earlier recall")
+		recallErr.Violations = violations
+		return nil, recallErr
+	}
+	if len(recall.UnitIds) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "No units of batch "+batchNumber+" lot "+lotNumber+" are still in the supply chain")
+	}
+	for _, containerID := range containerIDs {
+		if err = putContainer(stub, *containers[containerID]); err != nil {
+			return nil, err
+		}
+	}
+	if err = putRecall(stub, recall); err != nil {
+		return nil, err
+	}
+	return []byte(recallID), nil
+}
+
+// AcknowledgeRecall records that the caller, as custodian of containerID, has
+// quarantined the recalled units it holds.
+func (t *PharmaChaincode) AcknowledgeRecall(stub shim.ChaincodeStubInterface, recallID string, containerID string, remarks string) ([]byte, error) {
+	fmt.Println("running AcknowledgeRecall:" + recallID + " for " + containerID)
+	recall, err := getRecall(stub, recallID)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, container.Custodian); err != nil {
+		return nil, err
+	}
+	if len(recalledUnits(container, recallID)) == 0 {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "container_id", "Container "+containerID+" holds no units of recall "+recallID)
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	recall.Acknowledgements = append(recall.Acknowledgements, RecallAcknowledgement{
+		Custodian:      container.Custodian,
+		ContainerId:    containerID,
+		Remarks:        remarks,
+		AcknowledgedAt: txTime,
+		TxID:           stub.GetTxID()})
+	if err = putRecall(stub, recall); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// GetRecall returns a recall with its acknowledgements.
+func (t *PharmaChaincode) GetRecall(stub shim.ChaincodeStubInterface, recallID string) ([]byte, error) {
+	recall, err := getRecall(stub, recallID)
+	if err != nil {
+		return nil, err
+	}
+	jsonVal, _ := json.Marshal(recall)
+	return jsonVal, nil
+}
+
+// GetRecallExposure lists every container currently holding units of the
+// recall, with its custodian and whether that custodian has acknowledged.
+func (t *PharmaChaincode) GetRecallExposure(stub shim.ChaincodeStubInterface, recallID string) ([]byte, error) {
+	recall, err := getRecall(stub, recallID)
+	if err != nil {
+		return nil, err
+	}
+	exposures := []RecallExposure{}
+	seen := make(map[string]bool)
+	for _, unitID := range recall.UnitIds {
+		location, err := getElementLocation(stub, ELEMENT_UNIT, unitID)
+		if err != nil {
+			return nil, err
+		}
+		if seen[location.ContainerId] {
+			continue
+		}
+		seen[location.ContainerId] = true
+		container, err := getContainer(stub, location.ContainerId)
+		if err != nil {
+			return nil, err
+		}
+		exposure := RecallExposure{
+			ContainerId:   container.ContainerId,
+			Custodian:     container.Custodian,
+			TransitStatus: container.Provenance.TransitStatus,
+			UnitIds:       recalledUnits(container, recallID)}
+		for _, acknowledgement := range recall.Acknowledgements {
+			if acknowledgement.ContainerId == container.ContainerId && acknowledgement.Custodian == container.Custodian {
+				exposure.Acknowledged = true
+			}
+		}
+		exposures = append(exposures, exposure)
+	}
+	jsonVal, _ := json.Marshal(exposures)
+	return jsonVal, nil
+}
+
+// recalledUnits lists the units of the container under the given recall.
+func recalledUnits(container Container, recallID string) []string {
+	var unitIDs []string
+	for _, pallet := range container.Elements.Pallets {
+		for _, palletCase := range pallet.Cases {
+			for _, unit := range palletCase.Units {
+				if unit.RecallId == recallID {
+					unitIDs = append(unitIDs, unit.UnitId)
+				}
+			}
+		}
+	}
+	return unitIDs
+}
+
+func getRecall(stub shim.ChaincodeStubInterface, recallID string) (Recall, error) {
+	recall := Recall{}
+	valAsbytes, err := stub.GetState(createCompositeKey(RECALL_INDEX, []string{recallID}))
+	if err != nil {
+		return recall, newError(ERR_STATE, "Failed to get state for recall "+recallID)
+	}
+	if len(valAsbytes) == 0 {
+		return recall, newFieldError(ERR_NOT_FOUND, "recall_id", "No recall "+recallID)
+	}
+	json.Unmarshal(valAsbytes, &recall)
+	return recall, nil
+}
+
+func putRecall(stub shim.ChaincodeStubInterface, recall Recall) error {
+	jsonVal, _ := json.Marshal(recall)
+	err := stub.PutState(createCompositeKey(RECALL_INDEX, []string{recall.RecallId}), jsonVal)
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for recall "+recall.RecallId)
+	}
+	return nil
+}
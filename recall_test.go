@@ -0,0 +1,139 @@
+package main
+
+import "testing"
+
+func TestInitiateRecall(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, stub *testStub, containerID string)
+		role      string
+		caller    string
+		args      []string
+		wantCode  string
+		wantUnits int
+	}{
+		{
+			name:      "manufacturer recalls its batch",
+			role:      ROLE_SUPPLIER,
+			caller:    "SUP",
+			args:      []string{"R1", "B1", "", "contamination"},
+			wantUnits: 8},
+		{
+			name:      "regulator recalls a lot",
+			role:      ROLE_REGULATOR,
+			caller:    "REG",
+			args:      []string{"R1", "B1", "L1", "contamination"},
+			wantUnits: 8},
+		{
+			name:     "other supplier",
+			role:     ROLE_SUPPLIER,
+			caller:   "SUP2",
+			args:     []string{"R1", "B1", "", "contamination"},
+			wantCode: ERR_FORBIDDEN},
+		{
+			name:     "distributor",
+			role:     ROLE_DISTRIBUTOR,
+			caller:   "DIST",
+			args:     []string{"R1", "B1", "", "contamination"},
+			wantCode: ERR_FORBIDDEN},
+		{
+			name:     "unknown batch",
+			role:     ROLE_REGULATOR,
+			caller:   "REG",
+			args:     []string{"R1", "B9", "", "contamination"},
+			wantCode: ERR_NOT_FOUND},
+		{
+			name:     "unknown lot",
+			role:     ROLE_REGULATOR,
+			caller:   "REG",
+			args:     []string{"R1", "B1", "L9", "contamination"},
+			wantCode: ERR_NOT_FOUND},
+		{
+			name: "recall ID reused",
+			setup: func(t *testing.T, stub *testStub, containerID string) {
+				shipTestContainer(t, stub, "B2")
+				runSteps(t, stub, []step{{ROLE_SUPPLIER, "SUP", "InitiateRecall", []string{"R1", "B2", "", "contamination"}, ""}})
+			},
+			role:     ROLE_SUPPLIER,
+			caller:   "SUP",
+			args:     []string{"R1", "B1", "", "contamination"},
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name: "overlapping recall",
+			setup: func(t *testing.T, stub *testStub, containerID string) {
+				runSteps(t, stub, []step{{ROLE_SUPPLIER, "SUP", "InitiateRecall", []string{"R0", "B1", "L1", "contamination"}, ""}})
+			},
+			role:     ROLE_REGULATOR,
+			caller:   "REG",
+			args:     []string{"R1", "B1", "", "contamination"},
+			wantCode: ERR_INVALID_ARGUMENT},
+		{
+			name: "destroyed units left out",
+			setup: func(t *testing.T, stub *testStub, containerID string) {
+				unitIDs := unitIDsOf(stub.getContainer(t, containerID))
+				runSteps(t, stub, []step{
+					{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""},
+					{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""},
+					{ROLE_DISTRIBUTOR, "DIST", "AcceptContainerbyDistributor", []string{containerID, "DIST", ""}, ""},
+					{ROLE_DISTRIBUTOR, "DIST", "DestroyUnits", []string{containerID, `["` + unitIDs[0] + `","` + unitIDs[1] + `"]`, TEST_DESTRUCTION}, ""},
+				})
+			},
+			role:      ROLE_SUPPLIER,
+			caller:    "SUP",
+			args:      []string{"R1", "B1", "", "contamination"},
+			wantUnits: 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			containerID := shipTestContainer(t, stub, "B1")
+			if test.setup != nil {
+				test.setup(t, stub, containerID)
+			}
+			_, err := stub.caller(test.role, test.caller).invoke("InitiateRecall", test.args...)
+			if code := errorCode(err); code != test.wantCode {
+				t.Fatalf("got %q (%v), want %q", code, err, test.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			recall, err := getRecall(stub, test.args[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recall.UnitIds) != test.wantUnits {
+				t.Fatalf("recalled %d units, want %d", len(recall.UnitIds), test.wantUnits)
+			}
+			container := stub.getContainer(t, containerID)
+			if len(recalledUnits(container, test.args[0])) != test.wantUnits {
+				t.Fatalf("container %s holds %d units of the recall, want %d", containerID, len(recalledUnits(container, test.args[0])), test.wantUnits)
+			}
+		})
+	}
+}
+
+func TestAcknowledgeRecall(t *testing.T) {
+	tests := []struct {
+		name     string
+		caller   string
+		recallID string
+		wantCode string
+	}{
+		{"custodian", "DIST", "R1", ""},
+		{"not the custodian", "LOG", "R1", ERR_FORBIDDEN},
+		{"unknown recall", "DIST", "R9", ERR_NOT_FOUND},
+		{"container outside the recall", "DIST", "R2", ERR_INVALID_ARGUMENT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			containerID := deliverTestContainer(t, stub, "B1")
+			shipTestContainer(t, stub, "B2")
+			runSteps(t, stub, []step{
+				{ROLE_SUPPLIER, "SUP", "InitiateRecall", []string{"R1", "B1", "", "contamination"}, ""},
+				{ROLE_SUPPLIER, "SUP", "InitiateRecall", []string{"R2", "B2", "", "contamination"}, ""},
+				{ROLE_DISTRIBUTOR, test.caller, "AcknowledgeRecall", []string{test.recallID, containerID, "quarantined"}, test.wantCode},
+			})
+		})
+	}
+}
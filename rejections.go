@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Rejection reason codes, the controlled vocabulary for refusing a container
+// or part of one.
+const REASON_DAMAGED = "damaged"
+const REASON_TEMPERATURE_EXCURSION = "temperature_excursion"
+const REASON_QUANTITY_MISMATCH = "quantity_mismatch"
+const REASON_WRONG_RECIPIENT = "wrong_recipient"
+const REASON_DOCUMENTATION_MISSING = "documentation_missing"
+const REASON_SUSPECT_PRODUCT = "suspect_product"
+
+var rejectionReasons = []string{
+	REASON_DAMAGED,
+	REASON_TEMPERATURE_EXCURSION,
+	REASON_QUANTITY_MISMATCH,
+	REASON_WRONG_RECIPIENT,
+	REASON_DOCUMENTATION_MISSING,
+	REASON_SUSPECT_PRODUCT,
+}
+
+// REJECTION_INDEX keys a Rejection by reason code, transaction and element, so
+// a range scan returns every rejection for one reason.
+const REJECTION_INDEX = "reason~rejection"
+
+// ELEMENT_CONTAINER is the element type of a rejection of a whole container.
+const ELEMENT_CONTAINER = "container"
+
+// Rejection is one refused container, pallet or case, kept for quality
+// reporting.
+type Rejection struct {
+	ReasonCode  string    `json:"reason_code"`
+	Remarks     string    `json:"remarks,omitempty"`
+	ElementType string    `json:"element_type"`
+	ElementId   string    `json:"element_id"`
+	ContainerId string    `json:"container_id"`
+	Sender      string    `json:"sender"`
+	RejectedBy  string    `json:"rejected_by"`
+	RejectedAt  time.Time `json:"rejected_at"`
+	TxID        string    `json:"tx_id"`
+}
+
+// GetRejections lists recorded rejections with the given reason code, or all
+// of them when reasonCode is empty, ordered by reason code.
+func (t *PharmaChaincode) GetRejections(stub shim.ChaincodeStubInterface, reasonCode string) ([]byte, error) {
+	var attributes []string
+	if reasonCode != "" {
+		if err := checkReasonCode("reason_code", reasonCode); err != nil {
+			return nil, err
+		}
+		attributes = []string{reasonCode}
+	}
+	keys, err := rangeCompositeKeys(stub, REJECTION_INDEX, attributes)
+	if err != nil {
+		return nil, err
+	}
+	rejections := []Rejection{}
+	for _, key := range keys {
+		valAsbytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, newError(ERR_STATE, "Failed to get state for "+key)
+		}
+		rejection := Rejection{}
+		json.Unmarshal(valAsbytes, &rejection)
+		rejections = append(rejections, rejection)
+	}
+	jsonVal, _ := json.Marshal(rejections)
+	return jsonVal, nil
+}
+
+// checkReasonCode fails unless reasonCode is one of rejectionReasons.
+func checkReasonCode(field string, reasonCode string) error {
+	for _, known := range rejectionReasons {
+		if reasonCode == known {
+			return nil
+		}
+	}
+	return newFieldError(ERR_INVALID_ARGUMENT, field, "Unknown rejection reason "+reasonCode+", expecting one of "+strings.Join(rejectionReasons, ", "))
+}
+
+// recordRejection stores a rejection in the reason~rejection index, stamped
+// with the current transaction.
+func recordRejection(stub shim.ChaincodeStubInterface, rejection Rejection) error {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	rejection.RejectedAt = txTime
+	rejection.TxID = stub.GetTxID()
+	jsonVal, _ := json.Marshal(rejection)
+	err = stub.PutState(createCompositeKey(REJECTION_INDEX, []string{rejection.ReasonCode, rejection.TxID, rejection.ElementId}), jsonVal)
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for rejection of "+rejection.ElementType+" "+rejection.ElementId)
+	}
+	return nil
+}
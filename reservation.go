@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// RESERVATION_INDEX keys a Reservation by its container ID.
+const RESERVATION_INDEX = "reservation"
+
+// Reservation holds a block of container, pallet, case and unit IDs for the
+// participant that reserved them until they are used by a shipment.
+type Reservation struct {
+	ContainerId string    `json:"container_id"`
+	PalletIds   []string  `json:"pallet_ids"`
+	CaseIds     []string  `json:"case_ids"`
+	UnitIds     []string  `json:"unit_ids"`
+	ReservedBy  string    `json:"reserved_by"`
+	ReservedAt  time.Time `json:"reserved_at"`
+	TxID        string    `json:"tx_id"`
+	Used        bool      `json:"used"`
+}
+
+// ReserveContainer allocates the next container ID together with its pallet,
+// case and unit IDs, laid out by the named packaging template, for the caller
+// and returns the empty container. The counters are bumped in the same
+// transaction so no two callers can be handed the same IDs.
+func (t *PharmaChaincode) ReserveContainer(stub shim.ChaincodeStubInterface, templateName string) ([]byte, error) {
+	callerID, err := getCallerID(stub)
+	if err != nil {
+		return nil, err
+	}
+	template, err := getPackagingTemplate(stub, templateName)
+	if err != nil {
+		return nil, err
+	}
+	container, err := getEmptyContainer(stub, template)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("running ReserveContainer:" + container.ContainerId + " for " + callerID)
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	reservation := Reservation{
+		ContainerId: container.ContainerId,
+		ReservedBy:  callerID,
+		ReservedAt:  txTime,
+		TxID:        stub.GetTxID()}
+	for _, pallet := range container.Elements.Pallets {
+		reservation.PalletIds = append(reservation.PalletIds, pallet.PalletId)
+		for _, palletCase := range pallet.Cases {
+			reservation.CaseIds = append(reservation.CaseIds, palletCase.CaseId)
+			for _, unit := range palletCase.Units {
+				reservation.UnitIds = append(reservation.UnitIds, unit.UnitId)
+			}
+		}
+	}
+	err = putReservation(stub, reservation)
+	if err != nil {
+		return nil, err
+	}
+	err = incrementCounter(stub, len(container.Elements.Pallets))
+	if err != nil {
+		return nil, err
+	}
+	jsonVal, _ := json.Marshal(container)
+	return jsonVal, nil
+}
+
+// GetReservation returns the reservation made for containerID.
+func (t *PharmaChaincode) GetReservation(stub shim.ChaincodeStubInterface, containerID string) ([]byte, error) {
+	reservation, err := getReservation(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	jsonVal, _ := json.Marshal(reservation)
+	return jsonVal, nil
+}
+
+func getReservation(stub shim.ChaincodeStubInterface, containerID string) (Reservation, error) {
+	reservation := Reservation{}
+	valAsbytes, err := stub.GetState(createCompositeKey(RESERVATION_INDEX, []string{containerID}))
+	if err != nil {
+		return reservation, newError(ERR_STATE, "Failed to get state for reservation of container "+containerID)
+	}
+	if len(valAsbytes) == 0 {
+		return reservation, newError(ERR_NOT_FOUND, "Container ID "+containerID+" has not been reserved")
+	}
+	json.Unmarshal(valAsbytes, &reservation)
+	return reservation, nil
+}
+
+func putReservation(stub shim.ChaincodeStubInterface, reservation Reservation) error {
+	jsonVal, _ := json.Marshal(reservation)
+	err := stub.PutState(createCompositeKey(RESERVATION_INDEX, []string{reservation.ContainerId}), jsonVal)
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for reservation of container "+reservation.ContainerId)
+	}
+	return nil
+}
+
+// useReservation checks that every ID in a newly shipped container was
+// reserved by senderID and not used before, then marks the reservation used.
+func useReservation(stub shim.ChaincodeStubInterface, shipment Container, senderID string) error {
+	reservation, err := getReservation(stub, shipment.ContainerId)
+	if err != nil {
+		return err
+	}
+	if reservation.ReservedBy != senderID {
+		return newError(ERR_FORBIDDEN, "Container ID "+shipment.ContainerId+" is reserved by "+reservation.ReservedBy+", not "+senderID)
+	}
+	if reservation.Used {
+		return newError(ERR_INVALID_ARGUMENT, "Container ID "+shipment.ContainerId+" has already been used")
+	}
+
+	reserved := make(map[string]bool)
+	for _, ids := range [][]string{reservation.PalletIds, reservation.CaseIds, reservation.UnitIds} {
+		for _, id := range ids {
+			reserved[id] = true
+		}
+	}
+	var violations []string
+	checkReserved := func(id string) {
+		if !reserved[id] {
+			violations = append(violations, id+" is not part of the reservation for "+shipment.ContainerId)
+		}
+	}
+	for _, pallet := range shipment.Elements.Pallets {
+		checkReserved(pallet.PalletId)
+		for _, palletCase := range pallet.Cases {
+			checkReserved(palletCase.CaseId)
+			for _, unit := range palletCase.Units {
+				checkReserved(unit.UnitId)
+			}
+		}
+	}
+	if len(violations) > 0 {
+		reservationErr := newFieldError(ERR_INVALID_ARGUMENT, "elements_json", "Container uses unreserved IDs")
+		reservationErr.Violations = violations
+		return reservationErr
+	}
+
+	reservation.Used = true
+	return putReservation(stub, reservation)
+}
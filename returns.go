@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Dispositions accepted by DisposeReturn, with the status each moves the
+// container to.
+var returnDispositions = map[string]string{
+	"restock":    STATUS_RESTOCKED,
+	"quarantine": STATUS_QUARANTINED,
+	"destroy":    STATUS_DESTROYED,
+}
+
+// InitiateReturn starts sending a rejected container back to the party that
+// shipped it. The custodian, usually the carrier whose delivery was refused,
+// hands it to logisticsID, who ships it with ShipReturn; the two may be the
+// same party. An accepted container may only be returned once it holds units
+// too close to expiry to be moved on.
+func (t *PharmaChaincode) InitiateReturn(stub shim.ChaincodeStubInterface, containerID string, logisticsID string, remarks string) ([]byte, error) {
+	fmt.Println("running InitiateReturn:" + containerID)
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, container.Custodian); err != nil {
+		return nil, err
+	}
+	if err = checkTransition(container, STATUS_RETURN_INITIATED); err != nil {
+		return nil, err
+	}
+	if container.Provenance.TransitStatus == STATUS_ACCEPTED {
+		expiryErr := checkExpiry(stub, container)
+		if expiryErr == nil {
+			return nil, newError(ERR_INVALID_TRANSITION, "Container "+containerID+" was accepted and can only be returned once its units expire")
+		}
+		if chaincodeErr, ok := expiryErr.(*ChaincodeError); !ok || chaincodeErr.Code != ERR_EXPIRED {
+			return nil, expiryErr
+		}
+	}
+	origin := returnOrigin(container)
+	if origin == "" {
+		return nil, newError(ERR_STATE, "Container "+containerID+" has no shipment to return to")
+	}
+	if origin == container.Custodian {
+		return nil, newError(ERR_INVALID_TRANSITION, "Container "+containerID+" is already with its sender "+origin+" and can be disposed of directly")
+	}
+	chainActivity, err := newChainActivity(stub, container.Custodian, logisticsID, STATUS_RETURN_INITIATED)
+	if err != nil {
+		return nil, err
+	}
+	chainActivity.Remarks = remarks
+	container.ReturnTo = origin
+	container.Recipient = origin
+	container.Provenance.Supplychain = append(container.Provenance.Supplychain, chainActivity)
+	container.Provenance.TransitStatus = STATUS_RETURN_INITIATED
+	container.Provenance.Sender = container.Custodian
+	container.Provenance.Receiver = logisticsID
+	if err = putContainer(stub, container); err != nil {
+		return nil, err
+	}
+	if err = setCurrentOwner(stub, logisticsID, containerID); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ShipReturn records logistics picking up a returned container for its
+// origin.
+func (t *PharmaChaincode) ShipReturn(stub shim.ChaincodeStubInterface, containerID string, logisticsID string) ([]byte, error) {
+	fmt.Println("running ShipReturn:" + containerID)
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkNamedReceiver(container, logisticsID); err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, logisticsID); err != nil {
+		return nil, err
+	}
+	if err = checkTransition(container, STATUS_RETURN_SHIPPED); err != nil {
+		return nil, err
+	}
+	chainActivity, err := newChainActivity(stub, logisticsID, container.ReturnTo, STATUS_RETURN_SHIPPED)
+	if err != nil {
+		return nil, err
+	}
+	container.Provenance.Supplychain = append(container.Provenance.Supplychain, chainActivity)
+	container.Provenance.TransitStatus = STATUS_RETURN_SHIPPED
+	container.Provenance.Sender = logisticsID
+	container.Provenance.Receiver = container.ReturnTo
+	if err = transferCustody(stub, &container, logisticsID); err != nil {
+		return nil, err
+	}
+	if err = putContainer(stub, container); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ReceiveReturn records the origin taking a returned container back into its
+// custody.
+func (t *PharmaChaincode) ReceiveReturn(stub shim.ChaincodeStubInterface, containerID string, receiverID string, remarks string) ([]byte, error) {
+	fmt.Println("running ReceiveReturn:" + containerID)
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkNamedReceiver(container, receiverID); err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, receiverID); err != nil {
+		return nil, err
+	}
+	if err = checkTransition(container, STATUS_RETURNED); err != nil {
+		return nil, err
+	}
+	chainActivity, err := newChainActivity(stub, container.Provenance.Sender, receiverID, STATUS_RETURNED)
+	if err != nil {
+		return nil, err
+	}
+	chainActivity.Remarks = remarks
+	container.Provenance.Supplychain = append(container.Provenance.Supplychain, chainActivity)
+	container.Provenance.TransitStatus = STATUS_RETURNED
+	if err = transferCustody(stub, &container, receiverID); err != nil {
+		return nil, err
+	}
+	if err = putContainer(stub, container); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// DisposeReturn settles a container back with its origin: restock puts it
+// back into stock as accepted, quarantine holds it for a later decision and
+// destroy retires it for good, which needs destructionJSON as for
+// DestroyContainer.
+func (t *PharmaChaincode) DisposeReturn(stub shim.ChaincodeStubInterface, containerID string, disposition string, remarks string, destructionJSON string) ([]byte, error) {
+	fmt.Println("running DisposeReturn:" + containerID + " " + disposition)
+	status, ok := returnDispositions[disposition]
+	if !ok {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "disposition", "Expecting restock, quarantine or destroy, got "+disposition)
+	}
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCaller(stub, container.Custodian); err != nil {
+		return nil, err
+	}
+	if err = checkTransition(container, status); err != nil {
+		return nil, err
+	}
+	if err = checkReturnedToOrigin(container); err != nil {
+		return nil, err
+	}
+	if status == STATUS_DESTROYED {
+		destruction, err := parseDestruction(destructionJSON)
+		if err != nil {
+			return nil, err
+		}
+		if destruction.Remarks == "" {
+			destruction.Remarks = remarks
+		}
+		return nil, destroyContainer(stub, &container, destruction)
+	}
+	chainActivity, err := newChainActivity(stub, container.Custodian, container.Custodian, status)
+	if err != nil {
+		return nil, err
+	}
+	chainActivity.Remarks = remarks
+	container.Provenance.Supplychain = append(container.Provenance.Supplychain, chainActivity)
+	container.Provenance.TransitStatus = status
+	container.ReturnTo = ""
+	if status == STATUS_RESTOCKED {
+		// back in stock with the origin, which alone may ship it on
+		container.Provenance.TransitStatus = STATUS_ACCEPTED
+		container.Provenance.Sender = container.Custodian
+		container.Provenance.Receiver = container.Custodian
+	}
+	if err = putContainer(stub, container); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// checkReturnedToOrigin fails for a rejected container that has not yet gone
+// back to the party that shipped it, which alone may dispose of its contents.
+func checkReturnedToOrigin(container Container) error {
+	if container.Provenance.TransitStatus == STATUS_REJECTED && returnOrigin(container) != container.Custodian {
+		return newError(ERR_INVALID_TRANSITION, "Container "+container.ContainerId+" must be returned to "+returnOrigin(container)+" before it is disposed of")
+	}
+	return nil
+}
+
+// returnOrigin is the sender of the container's most recent shipment.
+func returnOrigin(container Container) string {
+	supplychain := container.Provenance.Supplychain
+	for index := len(supplychain) - 1; index >= 0; index-- {
+		if supplychain[index].Status == STATUS_SHIPPED {
+			return supplychain[index].Sender
+		}
+	}
+	return ""
+}
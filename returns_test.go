@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReturns(t *testing.T) {
+	rejectedByReceiver := func(containerID string) []step {
+		return []step{
+			{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""},
+			{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""},
+			{ROLE_DISTRIBUTOR, "DIST", "RejectContainerbyDistributor", []string{containerID, "DIST", "crushed", REASON_DAMAGED}, ""},
+		}
+	}
+	returned := func(containerID string) []step {
+		return append(rejectedByReceiver(containerID),
+			step{ROLE_LOGISTICS, "LOG", "InitiateReturn", []string{containerID, "LOG", ""}, ""},
+			step{ROLE_LOGISTICS, "LOG", "ShipReturn", []string{containerID, "LOG"}, ""},
+			step{ROLE_SUPPLIER, "SUP", "ReceiveReturn", []string{containerID, "SUP", ""}, ""})
+	}
+	tests := []struct {
+		name          string
+		expired       bool
+		steps         func(containerID string) []step
+		wantStatus    string
+		wantCustodian string
+	}{
+		{
+			name: "returned and restocked",
+			steps: func(containerID string) []step {
+				return append(returned(containerID),
+					step{ROLE_SUPPLIER, "SUP", "DisposeReturn", []string{containerID, "restock", "", ""}, ""})
+			},
+			wantStatus:    STATUS_ACCEPTED,
+			wantCustodian: "SUP"},
+		{
+			name: "returned and quarantined",
+			steps: func(containerID string) []step {
+				return append(returned(containerID),
+					step{ROLE_SUPPLIER, "SUP", "DisposeReturn", []string{containerID, "keep", "", ""}, ERR_INVALID_ARGUMENT},
+					step{ROLE_SUPPLIER, "SUP", "DisposeReturn", []string{containerID, "quarantine", "", ""}, ""},
+					step{ROLE_SUPPLIER, "SUP", "DisposeReturn", []string{containerID, "quarantine", "", ""}, ERR_INVALID_TRANSITION})
+			},
+			wantStatus:    STATUS_QUARANTINED,
+			wantCustodian: "SUP"},
+		{
+			name: "only the custodian starts a return",
+			steps: func(containerID string) []step {
+				return append(rejectedByReceiver(containerID),
+					step{ROLE_DISTRIBUTOR, "DIST", "InitiateReturn", []string{containerID, "LOG", ""}, ERR_FORBIDDEN})
+			},
+			wantStatus:    STATUS_REJECTED,
+			wantCustodian: "LOG"},
+		{
+			name: "only the named carrier ships a return",
+			steps: func(containerID string) []step {
+				return append(rejectedByReceiver(containerID),
+					step{ROLE_LOGISTICS, "LOG", "InitiateReturn", []string{containerID, "LOG2", ""}, ""},
+					step{ROLE_LOGISTICS, "LOG", "ShipReturn", []string{containerID, "LOG"}, ERR_FORBIDDEN},
+					step{ROLE_LOGISTICS, "LOG2", "ShipReturn", []string{containerID, "LOG2"}, ""})
+			},
+			wantStatus:    STATUS_RETURN_SHIPPED,
+			wantCustodian: "LOG2"},
+		{
+			name: "only the origin receives a return",
+			steps: func(containerID string) []step {
+				return append(rejectedByReceiver(containerID),
+					step{ROLE_LOGISTICS, "LOG", "InitiateReturn", []string{containerID, "LOG", ""}, ""},
+					step{ROLE_SUPPLIER, "SUP", "ReceiveReturn", []string{containerID, "SUP", ""}, ERR_FORBIDDEN},
+					step{ROLE_LOGISTICS, "LOG", "ShipReturn", []string{containerID, "LOG"}, ""},
+					step{ROLE_DISTRIBUTOR, "DIST", "ReceiveReturn", []string{containerID, "DIST", ""}, ERR_FORBIDDEN})
+			},
+			wantStatus:    STATUS_RETURN_SHIPPED,
+			wantCustodian: "LOG"},
+		{
+			name: "not disposed of away from the origin",
+			steps: func(containerID string) []step {
+				return append(rejectedByReceiver(containerID),
+					step{ROLE_SUPPLIER, "SUP", "DisposeReturn", []string{containerID, "restock", "", ""}, ERR_FORBIDDEN})
+			},
+			wantStatus:    STATUS_REJECTED,
+			wantCustodian: "LOG"},
+		{
+			name: "rejected by the carrier is disposed of directly",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG", "RejectContainerbyLogistics", []string{containerID, "LOG", "DIST", "crushed", REASON_DAMAGED}, ""},
+					{ROLE_SUPPLIER, "SUP", "InitiateReturn", []string{containerID, "LOG", ""}, ERR_FORBIDDEN},
+					{ROLE_SUPPLIER, "SUP", "DisposeReturn", []string{containerID, "restock", "", ""}, ""},
+				}
+			},
+			wantStatus:    STATUS_ACCEPTED,
+			wantCustodian: "SUP"},
+		{
+			name: "accepted stock is not returned before it expires",
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""},
+					{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""},
+					{ROLE_DISTRIBUTOR, "DIST", "AcceptContainerbyDistributor", []string{containerID, "DIST", ""}, ""},
+					{ROLE_DISTRIBUTOR, "DIST", "InitiateReturn", []string{containerID, "LOG", ""}, ERR_INVALID_TRANSITION},
+				}
+			},
+			wantStatus:    STATUS_ACCEPTED,
+			wantCustodian: "DIST"},
+		{
+			name:    "expired stock is returned",
+			expired: true,
+			steps: func(containerID string) []step {
+				return []step{
+					{ROLE_DISTRIBUTOR, "DIST", "InitiateReturn", []string{containerID, "LOG", ""}, ""},
+					{ROLE_LOGISTICS, "LOG", "ShipReturn", []string{containerID, "LOG"}, ""},
+					{ROLE_SUPPLIER, "SUP", "ReceiveReturn", []string{containerID, "SUP", ""}, ""},
+				}
+			},
+			wantStatus:    STATUS_RETURNED,
+			wantCustodian: "SUP"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			var containerID string
+			if test.expired {
+				containerID = deliverTestContainer(t, stub, "B1")
+				stub.now = time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+			} else {
+				containerID = shipTestContainer(t, stub, "B1")
+			}
+			runSteps(t, stub, test.steps(containerID))
+			container := stub.getContainer(t, containerID)
+			if container.Provenance.TransitStatus != test.wantStatus || container.Custodian != test.wantCustodian {
+				t.Fatalf("got %s with %s, want %s with %s", container.Provenance.TransitStatus, container.Custodian, test.wantStatus, test.wantCustodian)
+			}
+			if test.wantStatus == STATUS_ACCEPTED && container.Provenance.Receiver != test.wantCustodian {
+				t.Fatalf("accepted container names %s as receiver, want %s", container.Provenance.Receiver, test.wantCustodian)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SERIAL_INDEX keys a Serial by its serial number. Pallet, case and unit IDs
+// share one namespace, so no ID can be used twice whatever its type.
+const SERIAL_INDEX = "serial"
+
+// Serial statuses. A dispensed serial has left the supply chain; seeing it
+// shipped again suggests a counterfeit.
+const SERIAL_ACTIVE = "active"
+const SERIAL_DISPENSED = "dispensed"
+
+// Verdicts returned by VerifyUnit.
+const VERDICT_AUTHENTIC = "authentic"
+const VERDICT_SUSPECT = "suspect"
+const VERDICT_UNKNOWN = "unknown"
+
+// Serial is the registry entry of a pallet, case or unit ID, written the first
+// time the ID is shipped.
+type Serial struct {
+	SerialNumber    string     `json:"serial_number"`
+	ElementType     string     `json:"element_type"`
+	Status          string     `json:"status"`
+	ContainerId     string     `json:"container_id"`
+	RegisteredBy    string     `json:"registered_by"`
+	RegisteredAt    time.Time  `json:"registered_at"`
+	TxID            string     `json:"tx_id"`
+	StatusChangedBy string     `json:"status_changed_by,omitempty"`
+	StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+}
+
+// UnitVerification is the answer of VerifyUnit.
+type UnitVerification struct {
+	UnitId  string   `json:"unit_id"`
+	Verdict string   `json:"verdict"`
+	Reasons []string `json:"reasons"`
+}
+
+// checkSerials refuses a new container that reuses a serial already shipped
+// in another container. Reuse of a serial that has left the supply chain is
+// reported as suspect rather than as a plain duplicate.
+func checkSerials(stub shim.ChaincodeStubInterface, container Container) error {
+	var duplicates, suspects []string
+	check := func(elementType string, elementID string) error {
+		use, suspect, err := serialInUse(stub, elementType, elementID)
+		if suspect {
+			suspects = append(suspects, use)
+		} else if use != "" {
+			duplicates = append(duplicates, use)
+		}
+		return err
+	}
+	for _, pallet := range container.Elements.Pallets {
+		if err := check(ELEMENT_PALLET, pallet.PalletId); err != nil {
+			return err
+		}
+		for _, palletCase := range pallet.Cases {
+			if err := check(ELEMENT_CASE, palletCase.CaseId); err != nil {
+				return err
+			}
+			for _, unit := range palletCase.Units {
+				if err := check(ELEMENT_UNIT, unit.UnitId); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(suspects) > 0 {
+		fmt.Println("suspect serials in container " + container.ContainerId)
+		serialErr := newFieldError(ERR_SUSPECT_SERIAL, "elements_json", "Container "+container.ContainerId+" reuses serials that have left the supply chain")
+		serialErr.Violations = append(suspects, duplicates...)
+		return serialErr
+	}
+	if len(duplicates) > 0 {
+		serialErr := newFieldError(ERR_DUPLICATE_SERIAL, "elements_json", "Container "+container.ContainerId+" reuses registered serials")
+		serialErr.Violations = duplicates
+		return serialErr
+	}
+	return nil
+}
+
+// serialInUse describes an earlier use of a serial, or returns "" when it is
+// free. suspect is set when the serial has left the supply chain.
+func serialInUse(stub shim.ChaincodeStubInterface, elementType string, elementID string) (string, bool, error) {
+	serial, err := getSerial(stub, elementID)
+	if err != nil {
+		return "", false, err
+	}
+	if serial != nil {
+		if serial.Status != SERIAL_ACTIVE {
+			return elementType + " " + elementID + " was " + serial.Status + " and has reappeared", true, nil
+		}
+		return elementType + " " + elementID + " is already registered to container " + serial.ContainerId, false, nil
+	}
+	// elements shipped before the registry existed are only in the location index
+	for _, indexedType := range []string{ELEMENT_PALLET, ELEMENT_CASE, ELEMENT_UNIT} {
+		location, err := getElementLocation(stub, indexedType, elementID)
+		if err == nil {
+			return elementType + " " + elementID + " is already in container " + location.ContainerId, false, nil
+		}
+		if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ERR_NOT_FOUND {
+			return "", false, err
+		}
+	}
+	return "", false, nil
+}
+
+// registerSerials adds every pallet, case and unit of a newly shipped
+// container to the serial registry.
+func registerSerials(stub shim.ChaincodeStubInterface, container Container, senderID string, txTime time.Time) error {
+	register := func(elementType string, elementID string) error {
+		return putSerial(stub, Serial{
+			SerialNumber: elementID,
+			ElementType:  elementType,
+			Status:       SERIAL_ACTIVE,
+			ContainerId:  container.ContainerId,
+			RegisteredBy: senderID,
+			RegisteredAt: txTime,
+			TxID:         stub.GetTxID()})
+	}
+	for _, pallet := range container.Elements.Pallets {
+		if err := register(ELEMENT_PALLET, pallet.PalletId); err != nil {
+			return err
+		}
+		for _, palletCase := range pallet.Cases {
+			if err := register(ELEMENT_CASE, palletCase.CaseId); err != nil {
+				return err
+			}
+			for _, unit := range palletCase.Units {
+				if err := register(ELEMENT_UNIT, unit.UnitId); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// backfillSerials registers the elements of a container shipped before the
+// serial registry existed. Serials already registered are left alone.
+func backfillSerials(stub shim.ChaincodeStubInterface, container Container, senderID string, shippedAt time.Time) error {
+	register := func(elementType string, elementID string) error {
+		serial, err := getSerial(stub, elementID)
+		if err != nil || serial != nil {
+			return err
+		}
+		return putSerial(stub, Serial{
+			SerialNumber: elementID,
+			ElementType:  elementType,
+			Status:       SERIAL_ACTIVE,
+			ContainerId:  container.ContainerId,
+			RegisteredBy: senderID,
+			RegisteredAt: shippedAt,
+			TxID:         stub.GetTxID()})
+	}
+	for _, pallet := range container.Elements.Pallets {
+		if err := register(ELEMENT_PALLET, pallet.PalletId); err != nil {
+			return err
+		}
+		for _, palletCase := range pallet.Cases {
+			if err := register(ELEMENT_CASE, palletCase.CaseId); err != nil {
+				return err
+			}
+			for _, unit := range palletCase.Units {
+				if err := register(ELEMENT_UNIT, unit.UnitId); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// retireSerial moves a serial out of SERIAL_ACTIVE. Serials shipped before the
+// registry existed are registered on the way.
+func retireSerial(stub shim.ChaincodeStubInterface, elementType string, elementID string, containerID string, status string, callerID string, txTime time.Time) error {
+	serial, err := getSerial(stub, elementID)
+	if err != nil {
+		return err
+	}
+	if serial == nil {
+		serial = &Serial{
+			SerialNumber: elementID,
+			ElementType:  elementType,
+			ContainerId:  containerID,
+			RegisteredBy: callerID,
+			RegisteredAt: txTime,
+			TxID:         stub.GetTxID()}
+	}
+	serial.Status = status
+	serial.StatusChangedBy = callerID
+	serial.StatusChangedAt = &txTime
+	return putSerial(stub, *serial)
+}
+
+// VerifyUnit tells a scanner whether a unit ID is a genuine unit that may be
+// handed out. Unregistered IDs are unknown; IDs that have left the supply
+// chain, or belong to recalled, expired or compromised units, are suspect.
+func (t *PharmaChaincode) VerifyUnit(stub shim.ChaincodeStubInterface, unitID string) ([]byte, error) {
+	verification := UnitVerification{UnitId: unitID, Verdict: VERDICT_AUTHENTIC, Reasons: []string{}}
+	suspect := func(reason string) {
+		verification.Verdict = VERDICT_SUSPECT
+		verification.Reasons = append(verification.Reasons, reason)
+	}
+
+	serial, err := getSerial(stub, unitID)
+	if err != nil {
+		return nil, err
+	}
+	location, err := getElementLocation(stub, ELEMENT_UNIT, unitID)
+	if chaincodeErr, ok := err.(*ChaincodeError); ok && chaincodeErr.Code == ERR_NOT_FOUND {
+		if serial == nil {
+			verification.Verdict = VERDICT_UNKNOWN
+			verification.Reasons = append(verification.Reasons, "serial "+unitID+" has never been shipped")
+		} else {
+			suspect("serial " + unitID + " belongs to a " + serial.ElementType + ", not a unit")
+		}
+		jsonVal, _ := json.Marshal(verification)
+		return jsonVal, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if serial != nil && serial.Status != SERIAL_ACTIVE {
+		suspect("unit was " + serial.Status + " by " + serial.StatusChangedBy + " on " + serial.StatusChangedAt.Format(EXPIRY_DATE_LAYOUT))
+	}
+	container, err := getContainer(stub, location.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+	_, _, unit := findUnit(container, unitID)
+	if unit == nil {
+		suspect("unit is indexed in container " + container.ContainerId + " but not found there")
+		jsonVal, _ := json.Marshal(verification)
+		return jsonVal, nil
+	}
+	if unit.RecallId != "" {
+		suspect("unit is recalled under " + unit.RecallId)
+	}
+	if unit.HealthStatus == HEALTH_COMPROMISED {
+		suspect("unit storage conditions were compromised")
+	}
+	today, err := expiryCutoff(stub, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !unit.ExpiryDate.IsZero() && unit.ExpiryDate.Before(today) {
+		suspect("unit expired " + unit.ExpiryDate.String())
+	}
+	jsonVal, _ := json.Marshal(verification)
+	return jsonVal, nil
+}
+
+// getSerial returns the registry entry of a serial, or nil when it has none.
+func getSerial(stub shim.ChaincodeStubInterface, serialNumber string) (*Serial, error) {
+	valAsbytes, err := stub.GetState(createCompositeKey(SERIAL_INDEX, []string{serialNumber}))
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to get state for serial "+serialNumber)
+	}
+	if len(valAsbytes) == 0 {
+		return nil, nil
+	}
+	serial := Serial{}
+	json.Unmarshal(valAsbytes, &serial)
+	return &serial, nil
+}
+
+func putSerial(stub shim.ChaincodeStubInterface, serial Serial) error {
+	jsonVal, _ := json.Marshal(serial)
+	err := stub.PutState(createCompositeKey(SERIAL_INDEX, []string{serial.SerialNumber}), jsonVal)
+	if err != nil {
+		return newError(ERR_STATE, "Failed to put state for serial "+serial.SerialNumber)
+	}
+	return nil
+}
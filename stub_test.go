@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// TEST_TEMPLATE lays out the containers shipped by the tests: 2 pallets of 2
+// cases of 2 units.
+const TEST_TEMPLATE = `{"name":"test","pallet_count":2,"cases_per_pallet":2,"units_per_case":2,"drug_id":"D1"}`
+
+// TEST_DESTRUCTION is a valid destruction_json.
+const TEST_DESTRUCTION = `{"facility":"F1","method":"incineration","witness":"W1","certificate_hash":"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}`
+
+// testStub runs the chaincode on the shim MockStub, adding the caller
+// certificate attributes and transaction timestamps the MockStub lacks.
+type testStub struct {
+	*shim.MockStub
+	attributes map[string]string
+	now        time.Time
+	txCount    int
+}
+
+func newTestStub(t *testing.T) *testStub {
+	stub := &testStub{
+		MockStub:   shim.NewMockStub("pharma", new(PharmaChaincode)),
+		attributes: map[string]string{},
+		now:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	stub.MockTransactionStart("init")
+	_, err := new(PharmaChaincode).Init(stub, "init", nil)
+	stub.MockTransactionEnd("init")
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if _, err = stub.caller(ROLE_ADMIN, "ADM").invoke("SetPackagingTemplate", TEST_TEMPLATE); err != nil {
+		t.Fatalf("SetPackagingTemplate: %v", err)
+	}
+	return stub
+}
+
+func (stub *testStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	return []byte(stub.attributes[attributeName]), nil
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now.Unix()}, nil
+}
+
+// caller sets the certificate attributes of the following transactions.
+func (stub *testStub) caller(role string, participantID string) *testStub {
+	stub.attributes[ROLE_ATTRIBUTE] = role
+	stub.attributes[PARTICIPANT_ATTRIBUTE] = participantID
+	return stub
+}
+
+// invoke runs function as its own transaction, a minute after the previous
+// one.
+func (stub *testStub) invoke(function string, args ...string) ([]byte, error) {
+	stub.txCount++
+	stub.now = stub.now.Add(time.Minute)
+	txID := "tx" + strconv.Itoa(stub.txCount)
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return new(PharmaChaincode).Invoke(stub, function, args)
+}
+
+func (stub *testStub) query(function string, args ...string) ([]byte, error) {
+	return new(PharmaChaincode).Query(stub, function, args)
+}
+
+func (stub *testStub) getContainer(t *testing.T, containerID string) Container {
+	container, err := getContainer(stub, containerID)
+	if err != nil {
+		t.Fatalf("getContainer %s: %v", containerID, err)
+	}
+	return container
+}
+
+// errorCode returns the ChaincodeError code of err, or "" when err is nil.
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if chaincodeErr, ok := err.(*ChaincodeError); ok {
+		return chaincodeErr.Code
+	}
+	return err.Error()
+}
+
+// step is one transaction of a scripted scenario and the error code it is
+// expected to fail with, "" when it must succeed.
+type step struct {
+	role     string
+	caller   string
+	function string
+	args     []string
+	wantCode string
+}
+
+func runSteps(t *testing.T, stub *testStub, steps []step) {
+	t.Helper()
+	for index, s := range steps {
+		_, err := stub.caller(s.role, s.caller).invoke(s.function, s.args...)
+		if code := errorCode(err); code != s.wantCode {
+			t.Fatalf("step %d %s by %s: got %q (%v), want %q", index, s.function, s.caller, code, err, s.wantCode)
+		}
+	}
+}
+
+// shipTestContainer reserves a container for SUP, fills its units from
+// batchNumber and ships it through LOG to DIST. It returns the container ID.
+func shipTestContainer(t *testing.T, stub *testStub, batchNumber string) string {
+	t.Helper()
+	valAsbytes, err := stub.caller(ROLE_SUPPLIER, "SUP").invoke("ReserveContainer", "test")
+	if err != nil {
+		t.Fatalf("ReserveContainer: %v", err)
+	}
+	container := Container{}
+	json.Unmarshal(valAsbytes, &container)
+	for palletIndex := range container.Elements.Pallets {
+		for caseIndex := range container.Elements.Pallets[palletIndex].Cases {
+			units := container.Elements.Pallets[palletIndex].Cases[caseIndex].Units
+			for unitIndex := range units {
+				units[unitIndex].ExpiryDate = Date{Time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+				units[unitIndex].BatchNumber = batchNumber
+				units[unitIndex].LotNumber = "L1"
+			}
+		}
+	}
+	jsonVal, _ := json.Marshal(container)
+	if _, err = stub.invoke("ShipContainerUsingLogistics", "SUP", "LOG", "DIST", "", string(jsonVal)); err != nil {
+		t.Fatalf("ShipContainerUsingLogistics: %v", err)
+	}
+	return container.ContainerId
+}
+
+// deliverTestContainer ships a container and takes it through LOG to DIST,
+// who accepts it.
+func deliverTestContainer(t *testing.T, stub *testStub, batchNumber string) string {
+	t.Helper()
+	containerID := shipTestContainer(t, stub, batchNumber)
+	runSteps(t, stub, []step{
+		{ROLE_LOGISTICS, "LOG", "AcceptContainerbyLogistics", []string{containerID, "LOG", "DIST", ""}, ""},
+		{ROLE_LOGISTICS, "LOG", "DispatchContainer", []string{containerID, "DIST", ""}, ""},
+		{ROLE_DISTRIBUTOR, "DIST", "AcceptContainerbyDistributor", []string{containerID, "DIST", ""}, ""},
+	})
+	return containerID
+}
+
+// unitIDsOf lists the units of a container in layout order.
+func unitIDsOf(container Container) []string {
+	var unitIDs []string
+	for _, pallet := range container.Elements.Pallets {
+		for _, palletCase := range pallet.Cases {
+			for _, unit := range palletCase.Units {
+				unitIDs = append(unitIDs, unit.UnitId)
+			}
+		}
+	}
+	return unitIDs
+}
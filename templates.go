@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// TEMPLATE_INDEX keys a PackagingTemplate by its name.
+const TEMPLATE_INDEX = "template"
+
+// DEFAULT_TEMPLATE_NAME is used when no template is named. Until an admin
+// stores a template under this name, defaultTemplate applies.
+const DEFAULT_TEMPLATE_NAME = "default"
+
+// MAX_TEMPLATE_UNITS bounds the number of units a template may lay out, which
+// keeps a single container within a reasonable transaction size.
+const MAX_TEMPLATE_UNITS = 10000
+
+// PackagingTemplate describes how an empty container is laid out and the drug
+// metadata its units start with.
+type PackagingTemplate struct {
+	Name           string `json:"name"`
+	PalletCount    int    `json:"pallet_count"`
+	CasesPerPallet int    `json:"cases_per_pallet"`
+	UnitsPerCase   int    `json:"units_per_case"`
+	DrugId         string `json:"drug_id"`
+	DrugName       string `json:"drug_name"`
+}
+
+// defaultTemplate is the 3 pallets x 3 cases x 3 units layout the chaincode has
+// always used.
+var defaultTemplate = PackagingTemplate{
+	Name:           DEFAULT_TEMPLATE_NAME,
+	PalletCount:    3,
+	CasesPerPallet: 3,
+	UnitsPerCase:   3}
+
+// SetPackagingTemplate creates or replaces a named packaging template.
+func (t *PharmaChaincode) SetPackagingTemplate(stub shim.ChaincodeStubInterface, templateJSON string) ([]byte, error) {
+	template := PackagingTemplate{}
+	err := json.Unmarshal([]byte(templateJSON), &template)
+	if err != nil {
+		return nil, newFieldError(ERR_INVALID_ARGUMENT, "template_json", "Failed to parse template JSON: "+err.Error())
+	}
+	var violations []string
+	if template.Name == "" {
+		violations = append(violations, "name is required")
+	}
+	// each factor, then the partial product, is bounded before it is multiplied
+	// again so the unit count cannot overflow
+	if template.PalletCount < 1 || template.CasesPerPallet < 1 || template.UnitsPerCase < 1 {
+		violations = append(violations, "pallet_count, cases_per_pallet and units_per_case must all be at least 1")
+	} else if template.PalletCount > MAX_TEMPLATE_UNITS || template.CasesPerPallet > MAX_TEMPLATE_UNITS || template.UnitsPerCase > MAX_TEMPLATE_UNITS ||
+		template.PalletCount*template.CasesPerPallet > MAX_TEMPLATE_UNITS ||
+		template.PalletCount*template.CasesPerPallet*template.UnitsPerCase > MAX_TEMPLATE_UNITS {
+		violations = append(violations, "template lays out more than "+strconv.Itoa(MAX_TEMPLATE_UNITS)+" units")
+	}
+	if len(violations) > 0 {
+		templateErr := newFieldError(ERR_INVALID_ARGUMENT, "template_json", "Template failed validation")
+		templateErr.Violations = violations
+		return nil, templateErr
+	}
+	fmt.Println("running SetPackagingTemplate:" + template.Name)
+	jsonVal, _ := json.Marshal(template)
+	err = stub.PutState(createCompositeKey(TEMPLATE_INDEX, []string{template.Name}), jsonVal)
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to put state for template "+template.Name)
+	}
+	return nil, nil
+}
+
+// DeletePackagingTemplate removes a named packaging template.
+func (t *PharmaChaincode) DeletePackagingTemplate(stub shim.ChaincodeStubInterface, templateName string) ([]byte, error) {
+	if _, err := getStoredTemplate(stub, templateName); err != nil {
+		return nil, err
+	}
+	err := stub.DelState(createCompositeKey(TEMPLATE_INDEX, []string{templateName}))
+	if err != nil {
+		return nil, newError(ERR_STATE, "Failed to delete state for template "+templateName)
+	}
+	return nil, nil
+}
+
+// GetPackagingTemplates lists every stored packaging template.
+func (t *PharmaChaincode) GetPackagingTemplates(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	keys, err := rangeCompositeKeys(stub, TEMPLATE_INDEX, nil)
+	if err != nil {
+		return nil, err
+	}
+	templates := []PackagingTemplate{}
+	for _, key := range keys {
+		_, attributes := splitCompositeKey(key)
+		template, err := getStoredTemplate(stub, attributes[0])
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	jsonVal, _ := json.Marshal(templates)
+	return jsonVal, nil
+}
+
+// getPackagingTemplate resolves templateName, falling back to the default
+// template when it is empty.
+func getPackagingTemplate(stub shim.ChaincodeStubInterface, templateName string) (PackagingTemplate, error) {
+	if templateName == "" {
+		template, err := getStoredTemplate(stub, DEFAULT_TEMPLATE_NAME)
+		if chaincodeErr, ok := err.(*ChaincodeError); ok && chaincodeErr.Code == ERR_NOT_FOUND {
+			return defaultTemplate, nil
+		}
+		return template, err
+	}
+	return getStoredTemplate(stub, templateName)
+}
+
+func getStoredTemplate(stub shim.ChaincodeStubInterface, templateName string) (PackagingTemplate, error) {
+	template := PackagingTemplate{}
+	valAsbytes, err := stub.GetState(createCompositeKey(TEMPLATE_INDEX, []string{templateName}))
+	if err != nil {
+		return template, newError(ERR_STATE, "Failed to get state for template "+templateName)
+	}
+	if len(valAsbytes) == 0 {
+		return template, newFieldError(ERR_NOT_FOUND, "template_name", "No packaging template named "+templateName)
+	}
+	json.Unmarshal(valAsbytes, &template)
+	return template, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+)
+
+// EXPIRY_DATE_LAYOUT is the format expected for Unit.ExpiryDate.
+const EXPIRY_DATE_LAYOUT = "2006-01-02"
+
+// checkNewContainer validates a container shipped for the first time. Once on
+// the ledger its contents change only through split, merge and repack, so
+// re-shipments are not validated again.
+func checkNewContainer(container Container) error {
+	violations := validateContainer(container)
+	if len(violations) > 0 {
+		validationErr := newFieldError(ERR_INVALID_ARGUMENT, "elements_json", "Container failed validation")
+		validationErr.Violations = violations
+		return validationErr
+	}
+	return nil
+}
+
+// validateContainer checks a submitted container and returns every violation
+// found rather than stopping at the first one. IDs must be unique across the
+// whole container and each one must extend the ID of its parent.
+func validateContainer(container Container) []string {
+	var violations []string
+	seen := make(map[string]bool)
+	checkID := func(kind string, id string, parentID string, location string) {
+		if id == "" {
+			violations = append(violations, location+": "+kind+" is required")
+			return
+		}
+		if seen[id] {
+			violations = append(violations, location+": duplicate "+kind+" "+id)
+		}
+		seen[id] = true
+		if parentID != "" && !strings.HasPrefix(id, parentID) {
+			violations = append(violations, location+": "+kind+" "+id+" does not start with parent ID "+parentID)
+		}
+	}
+
+	checkID("container_id", container.ContainerId, "", "container")
+	if len(container.Elements.Pallets) == 0 {
+		violations = append(violations, "container: at least one pallet is required")
+	}
+	for _, pallet := range container.Elements.Pallets {
+		palletLocation := "pallet " + pallet.PalletId
+		checkID("pallet_id", pallet.PalletId, container.ContainerId, palletLocation)
+		if len(pallet.Cases) == 0 {
+			violations = append(violations, palletLocation+": at least one case is required")
+		}
+		for _, palletCase := range pallet.Cases {
+			caseLocation := "case " + palletCase.CaseId
+			checkID("case_id", palletCase.CaseId, pallet.PalletId, caseLocation)
+			if len(palletCase.Units) == 0 {
+				violations = append(violations, caseLocation+": at least one unit is required")
+			}
+			for _, unit := range palletCase.Units {
+				unitLocation := "unit " + unit.UnitId
+				checkID("unit_id", unit.UnitId, palletCase.CaseId, unitLocation)
+				if unit.DrugId == "" {
+					violations = append(violations, unitLocation+": drug_id is required")
+				}
+				if unit.ExpiryDate.IsZero() {
+					violations = append(violations, unitLocation+": expiry_date "+unit.ExpiryDate.String()+" is not a date in "+EXPIRY_DATE_LAYOUT+" format")
+				}
+			}
+		}
+	}
+	return violations
+}